@@ -0,0 +1,96 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// unsafeCollectionChars are runs of characters Chroma doesn't allow in
+// collection names.
+var unsafeCollectionChars = regexp.MustCompile(`[^a-zA-Z0-9_-]+`)
+
+// gitRoot walks up from dir looking for a .git entry (a directory, or a
+// file in worktrees and submodules) and returns the working tree's top
+// level, or "" outside any repository.
+func gitRoot(dir string) string {
+	for {
+		if _, err := os.Stat(filepath.Join(dir, ".git")); err == nil {
+			return dir
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return ""
+		}
+		dir = parent
+	}
+}
+
+// repoCollectionName derives a collection name from a repository root: its
+// directory name plus a short hash of the full path, so two checkouts that
+// happen to share a name keep separate indexes.
+func repoCollectionName(root string) string {
+	sum := sha1.Sum([]byte(root))
+	base := strings.Trim(unsafeCollectionChars.ReplaceAllString(filepath.Base(root), "-"), "-_")
+	if base == "" {
+		base = "repo"
+	}
+	// Chroma caps names at 63 characters
+	if len(base) > 54 {
+		base = base[:54]
+	}
+	return fmt.Sprintf("%s-%s", base, hex.EncodeToString(sum[:4]))
+}
+
+// collectionName picks the collection for this run: --collection if given,
+// else with --auto-collection the current git repository's, else the one
+// chosen with jb-recall use, else "" for the default collection.
+func collectionName(rootDir string, args []string) string {
+	if v, ok := flagValue(args, "--collection"); ok {
+		return v
+	}
+	if contains(args, "--auto-collection") {
+		if cwd, err := os.Getwd(); err == nil {
+			if root := gitRoot(cwd); root != "" {
+				return repoCollectionName(root)
+			}
+		}
+	}
+	return currentCollection(rootDir)
+}
+
+func currentCollectionPath(rootDir string) string {
+	return filepath.Join(rootDir, "current_collection")
+}
+
+// currentCollection is the collection set with jb-recall use, or "".
+func currentCollection(rootDir string) string {
+	data, err := os.ReadFile(currentCollectionPath(rootDir))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// useCollection makes name the collection later commands default to; ""
+// goes back to the built-in default.
+func useCollection(rootDir, name string) error {
+	if name == "" {
+		err := os.Remove(currentCollectionPath(rootDir))
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if unsafeCollectionChars.MatchString(name) {
+		return fmt.Errorf("invalid collection name %q (letters, digits, - and _ only)", name)
+	}
+	if err := os.MkdirAll(rootDir, 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(currentCollectionPath(rootDir), []byte(name+"\n"), 0644)
+}
@@ -0,0 +1,408 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Config holds settings read from config.json in the root directory.
+// Command-line flags take precedence over anything set here.
+type Config struct {
+	Channel          string            `json:"channel,omitempty"`
+	EmbeddingBackend string            `json:"embedding_backend,omitempty"`
+	ChunkStrategy    map[string]string `json:"chunk_strategy,omitempty"`
+	Framing          string            `json:"framing,omitempty"`
+	Preprocess       []Preprocessor    `json:"preprocess,omitempty"`
+	QueryPrefix      string            `json:"query_prefix,omitempty"`
+	PassagePrefix    string            `json:"passage_prefix,omitempty"`
+	MaxLimit         int               `json:"max_limit,omitempty"`
+	Daemon           bool              `json:"daemon,omitempty"`
+	LogFormat        string            `json:"log_format,omitempty"`
+	ReadOnly         bool              `json:"read_only,omitempty"`
+	PreviewChars     int               `json:"preview_chars,omitempty"`
+	ChunkIDs         string            `json:"chunk_ids,omitempty"`
+	Hnsw             HnswConfig        `json:"hnsw,omitempty"`
+	MaxTextBytes     int               `json:"max_results_text_bytes,omitempty"`
+	RecencyHalfLife  float64           `json:"recency_half_life,omitempty"`
+	Watch            []string          `json:"watch,omitempty"`
+	WatchInterval    int               `json:"watch_interval,omitempty"` // seconds
+	Frontmatter      string            `json:"frontmatter,omitempty"`
+}
+
+// watchDirs returns the directories daemon --watch keeps indexed, absolute
+// and with a leading ~ expanded.
+func (c *Config) watchDirs() ([]string, error) {
+	var dirs []string
+	for _, dir := range c.Watch {
+		abs, err := absHome(dir)
+		if err != nil {
+			return nil, err
+		}
+		if info, err := os.Stat(abs); err != nil || !info.IsDir() {
+			return nil, fmt.Errorf("watch: %s is not a directory", dir)
+		}
+		dirs = append(dirs, abs)
+	}
+	return dirs, nil
+}
+
+// absHome makes path absolute, expanding a leading ~ to the home directory.
+func absHome(path string) (string, error) {
+	if path == "~" || strings.HasPrefix(path, "~/") {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		path = filepath.Join(home, path[1:])
+	}
+	return filepath.Abs(path)
+}
+
+// HnswConfig holds defaults for the --hnsw-* and --ef-search flags.
+type HnswConfig struct {
+	EfConstruction int `json:"ef_construction,omitempty"`
+	M              int `json:"m,omitempty"`
+	EfSearch       int `json:"ef_search,omitempty"`
+}
+
+// defaultMaxLimit caps --limit unless config.json sets max_limit, so a
+// typo can't ask Chroma for the whole collection at once.
+const defaultMaxLimit = 1000
+
+// defaultMaxTextBytes caps the result text in one search response, so huge
+// chunks can't make a response line megabytes long.
+const defaultMaxTextBytes = 1 << 20
+
+func (c *Config) maxLimit() int {
+	if c.MaxLimit > 0 {
+		return c.MaxLimit
+	}
+	return defaultMaxLimit
+}
+
+// Preprocessor is a regex replacement applied to file text before chunking,
+// e.g. to drop license headers. Patterns use Python's re syntax since that
+// is where they run; use (?m) and friends for flags.
+type Preprocessor struct {
+	Name    string `json:"name"`
+	Pattern string `json:"pattern"`
+	Replace string `json:"replace"`
+}
+
+// codeFences replaces each fenced code block, ``` or ~~~ up to a closing
+// fence of the same kind, with a placeholder, so code in notes doesn't pull
+// prose queries toward it. An unclosed fence is left alone.
+var codeFences = Preprocessor{
+	Name:    "strip-code-fences",
+	Pattern: "(?ms)^[ \t]*(```|~~~)[^\n]*\n.*?^[ \t]*\\1[ \t]*$",
+	Replace: "[code block]",
+}
+
+// preprocessors returns the config's preprocessors followed by one per
+// --strip-pattern, which deletes matches with ^ and $ anchored at lines,
+// and then codeFences with --strip-code-fences. --strip-pattern is
+// repeatable and, being a regex, isn't split on commas.
+func preprocessors(cfg *Config, args []string) []Preprocessor {
+	list := append([]Preprocessor(nil), cfg.Preprocess...)
+	for i, a := range args {
+		if a == "--strip-pattern" && i+1 < len(args) {
+			list = append(list, Preprocessor{
+				Name:    fmt.Sprintf("strip-pattern-%d", len(list)-len(cfg.Preprocess)+1),
+				Pattern: "(?m)" + args[i+1],
+			})
+		}
+	}
+	if contains(args, "--strip-code-fences") {
+		list = append(list, codeFences)
+	}
+	return list
+}
+
+// chunkIDSchemes are the ways recall.py can derive chunk IDs.
+var chunkIDSchemes = []string{"index", "content"}
+
+// chunkIDsFlag is the chunk ID scheme: --chunk-ids, else chunk_ids from
+// the config, else "" for recall.py's default.
+func chunkIDsFlag(cfg *Config, args []string) (string, error) {
+	scheme, ok := flagValue(args, "--chunk-ids")
+	if !ok {
+		scheme = cfg.ChunkIDs
+	}
+	if scheme != "" && !contains(chunkIDSchemes, scheme) {
+		return "", fmt.Errorf("--chunk-ids must be one of %s", strings.Join(chunkIDSchemes, ", "))
+	}
+	return scheme, nil
+}
+
+// frontmatterModes are how index can treat markdown frontmatter: "fields"
+// stores it as searchable metadata, "title" also indexes the title as text.
+var frontmatterModes = []string{"fields", "title"}
+
+// frontmatterFlag is the frontmatter mode: "title" with --frontmatter-title,
+// "fields" with --frontmatter, else frontmatter from the config, else "" to
+// index frontmatter as ordinary text.
+func frontmatterFlag(cfg *Config, args []string) (string, error) {
+	switch {
+	case contains(args, "--frontmatter-title"):
+		return "title", nil
+	case contains(args, "--frontmatter"):
+		return "fields", nil
+	case cfg.Frontmatter != "" && !contains(frontmatterModes, cfg.Frontmatter):
+		return "", fmt.Errorf("frontmatter must be one of %s", strings.Join(frontmatterModes, ", "))
+	}
+	return cfg.Frontmatter, nil
+}
+
+// chunkStrategyNames are the chunkers recall.py knows about.
+var chunkStrategyNames = map[string]bool{"fixed": true, "markdown": true, "code": true}
+
+// loadConfig reads the config file at path. A missing file is not an error
+// and yields the defaults.
+func loadConfig(path string, required bool) (*Config, error) {
+	cfg := &Config{}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		// Only the default location is optional
+		if required {
+			return nil, fmt.Errorf("config file %s does not exist", path)
+		}
+		return cfg, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("invalid config %s: %w", path, err)
+	}
+	for i, p := range cfg.Preprocess {
+		if p.Name == "" || p.Pattern == "" {
+			return nil, fmt.Errorf("invalid config %s: preprocess entry %d needs a name and a pattern", path, i+1)
+		}
+	}
+	return cfg, nil
+}
+
+// configReloader rereads the config file when serve or a daemon gets
+// SIGHUP, so settings can change without reloading the model.
+type configReloader struct {
+	rootDir  string
+	path     string
+	required bool
+	args     []string
+	opts     ClientOptions // what the process started with
+}
+
+// load reads the config file again. Settings that shape the Python process
+// or the collection are fixed at startup, so any that now differ are only
+// logged. The flags still take precedence, so a setting they override
+// doesn't count as changed.
+func (r *configReloader) load() (*Config, error) {
+	cfg, err := loadConfig(r.path, r.required)
+	if err != nil {
+		return nil, err
+	}
+	opts := clientOptions(r.rootDir, cfg, r.args)
+	var changed []string
+	for _, s := range []struct {
+		name   string
+		differ bool
+	}{
+		{"channel", opts.Channel != r.opts.Channel},
+		{"embedding_backend", opts.Backend != r.opts.Backend},
+		{"framing", opts.Framing != r.opts.Framing},
+		{"query_prefix", opts.QueryPrefix != r.opts.QueryPrefix},
+		{"passage_prefix", opts.PassagePrefix != r.opts.PassagePrefix},
+		{"read_only", opts.ReadOnly != r.opts.ReadOnly},
+		{"max_results_text_bytes", opts.MaxTextBytes != r.opts.MaxTextBytes},
+		{"hnsw", opts.HnswEfConstruction != r.opts.HnswEfConstruction || opts.HnswM != r.opts.HnswM || opts.EfSearch != r.opts.EfSearch},
+	} {
+		if s.differ {
+			changed = append(changed, s.name)
+		}
+	}
+	if len(changed) > 0 {
+		logger.Warn(fmt.Sprintf("Config changes to %s take effect after a restart", strings.Join(changed, ", ")), "settings", changed)
+	}
+	return cfg, nil
+}
+
+// clientOptions merges the config file with command-line overrides.
+func clientOptions(rootDir string, cfg *Config, args []string) ClientOptions {
+	opts := ClientOptions{Channel: defaultChannel, Backend: defaultBackend}
+	if cfg.Channel != "" {
+		opts.Channel = cfg.Channel
+	}
+	if v, ok := flagValue(args, "--channel"); ok {
+		opts.Channel = v
+	}
+	if cfg.EmbeddingBackend != "" {
+		opts.Backend = cfg.EmbeddingBackend
+	}
+	if v, ok := flagValue(args, "--embedding-backend"); ok {
+		opts.Backend = v
+	}
+	opts.Threads = intFlag(args, "--threads", 0)
+	opts.Collection = collectionName(rootDir, args)
+	opts.NoInstall = contains(args, "--no-install") || envBool("JB_RECALL_NO_INSTALL")
+	opts.Verbose = contains(args, "--verbose")
+	opts.ReadOnly = contains(args, "--read-only") || cfg.ReadOnly
+	opts.Script = os.Getenv("JB_RECALL_SCRIPT")
+	if v, ok := flagValue(args, "--script"); ok {
+		opts.Script = v
+	}
+	if opts.Script != "" {
+		// Python runs elsewhere, and tracebacks should name the real file
+		opts.Script, _ = filepath.Abs(opts.Script)
+	}
+	opts.HnswEfConstruction = intFlag(args, "--hnsw-ef-construction", cfg.Hnsw.EfConstruction)
+	opts.HnswM = intFlag(args, "--hnsw-m", cfg.Hnsw.M)
+	opts.EfSearch = intFlag(args, "--ef-search", cfg.Hnsw.EfSearch)
+	// 0 turns the cap off; only the flag can say so, as 0 in the config means unset
+	maxText := defaultMaxTextBytes
+	if cfg.MaxTextBytes > 0 {
+		maxText = cfg.MaxTextBytes
+	}
+	opts.MaxTextBytes = intFlag(args, "--max-results-text-bytes", maxText)
+	opts.Framing = cfg.Framing
+	if v, ok := flagValue(args, "--framing"); ok {
+		opts.Framing = v
+	}
+	opts.QueryPrefix = cfg.QueryPrefix
+	if v, ok := flagValue(args, "--query-prefix"); ok {
+		opts.QueryPrefix = v
+	}
+	opts.PassagePrefix = cfg.PassagePrefix
+	if v, ok := flagValue(args, "--passage-prefix"); ok {
+		opts.PassagePrefix = v
+	}
+	return opts
+}
+
+// chunkStrategies returns the extension -> chunk strategy map: the config
+// file's entries, overridden per extension by --chunk-strategy, e.g.
+// "md=markdown,py=code,default=fixed".
+func chunkStrategies(cfg *Config, args []string) (map[string]string, error) {
+	strategies := make(map[string]string)
+	for ext, name := range cfg.ChunkStrategy {
+		strategies[strings.TrimPrefix(strings.ToLower(ext), ".")] = name
+	}
+	if v, ok := flagValue(args, "--chunk-strategy"); ok {
+		for _, pair := range strings.Split(v, ",") {
+			ext, name, found := strings.Cut(strings.TrimSpace(pair), "=")
+			if !found || ext == "" {
+				return nil, fmt.Errorf("--chunk-strategy: expected ext=strategy, got %q", pair)
+			}
+			strategies[strings.TrimPrefix(strings.ToLower(ext), ".")] = name
+		}
+	}
+	for ext, name := range strategies {
+		if !chunkStrategyNames[name] {
+			return nil, fmt.Errorf("unknown chunk strategy %q for %s (want fixed, markdown or code)", name, ext)
+		}
+	}
+	return strategies, nil
+}
+
+// envBool reports whether the environment variable is set to a true value
+// such as 1, true or yes.
+func envBool(name string) bool {
+	switch strings.ToLower(os.Getenv(name)) {
+	case "1", "true", "yes", "on":
+		return true
+	}
+	return false
+}
+
+// previewFlag is how many characters of each result to show: --preview-chars,
+// else preview_chars from the config, else previewChars. 0, or
+// --no-truncate, shows results whole.
+func previewFlag(cfg *Config, args []string) int {
+	if contains(args, "--no-truncate") {
+		return 0
+	}
+	def := previewChars
+	if cfg.PreviewChars > 0 {
+		def = cfg.PreviewChars
+	}
+	n := intFlag(args, "--preview-chars", def)
+	if n < 0 {
+		fmt.Fprintf(os.Stderr, "Error: --preview-chars can't be negative, got %d\n", n)
+		os.Exit(1)
+	}
+	return n
+}
+
+// defaultHalfLife is the --recency-boost half-life in days.
+const defaultHalfLife = 30
+
+// halfLifeFlag is the recency boost's half-life in days: --half-life, else
+// recency_half_life from the config, else defaultHalfLife.
+func halfLifeFlag(cfg *Config, args []string) float64 {
+	def := float64(defaultHalfLife)
+	if cfg.RecencyHalfLife > 0 {
+		def = cfg.RecencyHalfLife
+	}
+	n := floatFlag(args, "--half-life", def)
+	if n <= 0 {
+		fmt.Fprintf(os.Stderr, "Error: --half-life must be a positive number of days, got %g\n", n)
+		os.Exit(1)
+	}
+	return n
+}
+
+// scoreWeightsFlag parses --score-weights, a comma-separated list of
+// key=weight pairs: vector for similarity, recency for how recently a chunk
+// was indexed, tag:<name> for chunks with that tag and path:<dir> for files
+// under dir. nil means the flag wasn't given.
+func scoreWeightsFlag(args []string) (map[string]float64, error) {
+	v, ok := flagValue(args, "--score-weights")
+	if !ok {
+		return nil, nil
+	}
+	weights := make(map[string]float64)
+	for _, pair := range strings.Split(v, ",") {
+		i := strings.LastIndex(pair, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("--score-weights: %q is not key=weight", pair)
+		}
+		key, value := strings.TrimSpace(pair[:i]), strings.TrimSpace(pair[i+1:])
+		weight, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return nil, fmt.Errorf("--score-weights: %q is not a number", value)
+		}
+		switch {
+		case key == "vector", key == "recency":
+		case strings.HasPrefix(key, "tag:") && len(key) > len("tag:"):
+		case strings.HasPrefix(key, "path:") && len(key) > len("path:"):
+			dir, err := absHome(key[len("path:"):])
+			if err != nil {
+				return nil, err
+			}
+			key = "path:" + dir
+		default:
+			return nil, fmt.Errorf("--score-weights: unknown key %q; want vector, recency, tag:<name> or path:<dir>", key)
+		}
+		weights[key] = weight
+	}
+	return weights, nil
+}
+
+// limitFlag reads --limit, defaulting to def and clamping to max with a
+// warning. 0 means "no limit" where allowUnlimited (filtered listings) and
+// is rejected elsewhere, as are negative values.
+func limitFlag(args []string, def, max int, allowUnlimited bool) int {
+	n := intFlag(args, "--limit", def)
+	switch {
+	case n < 0, n == 0 && !allowUnlimited:
+		fmt.Fprintf(os.Stderr, "Error: --limit must be a positive number, got %d\n", n)
+		os.Exit(1)
+	case n > max:
+		fmt.Fprintf(os.Stderr, "Warning: --limit %d exceeds the maximum of %d; using %d (raise max_limit in config.json)\n", n, max, max)
+		n = max
+	}
+	return n
+}
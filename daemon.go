@@ -0,0 +1,333 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// With --daemon, CLI commands run against a background helper that keeps
+// Python and the model loaded. The first command starts it; it exits once
+// it has had no clients for the idle timeout. Helpers are keyed by the
+// options that shape the Python process, so a command with a different
+// backend gets its own.
+
+// defaultDaemonIdle is how long the helper waits for another command.
+const defaultDaemonIdle = 5 * time.Minute
+
+// daemonStartTimeout bounds the wait for a new helper, which on first run
+// includes creating the environment and installing packages.
+const daemonStartTimeout = 15 * time.Minute
+
+// errDaemonRunning means another helper already holds the lock.
+var errDaemonRunning = errors.New("a jb-recall daemon with these options is already running")
+
+func daemonKey(opts ClientOptions) string {
+	sum := sha1.Sum([]byte(fmt.Sprintf("%s|%s|%d|%t|%s|%s", opts.Channel, opts.Backend, opts.Threads, opts.NoInstall, opts.Framing, opts.Script)))
+	return hex.EncodeToString(sum[:4])
+}
+
+// daemonBase is the path, minus extension, of the helper's lock file and
+// its endpoint: a Unix socket, or on Windows a file naming a loopback
+// TCP port (see daemon_windows.go).
+func daemonBase(rootDir string, opts ClientOptions) string {
+	return filepath.Join(rootDir, "daemon-"+daemonKey(opts))
+}
+
+func daemonLogPath(rootDir string) string {
+	return filepath.Join(rootDir, "daemon.log")
+}
+
+// connectDaemon returns a client for the warm helper, starting one if none
+// is listening.
+func connectDaemon(rootDir string, opts ClientOptions, args []string) (*RecallClient, error) {
+	base := daemonBase(rootDir, opts)
+	if client, err := dialDaemon(base, opts); err == nil {
+		return client, nil
+	}
+
+	exited, err := startDaemon(rootDir, args)
+	if err != nil {
+		return nil, err
+	}
+	logger.Info(fmt.Sprintf("Starting background helper (log: %s)...", daemonLogPath(rootDir)), "log", daemonLogPath(rootDir))
+	deadline := time.After(daemonStartTimeout)
+	for {
+		if client, err := dialDaemon(base, opts); err == nil {
+			return client, nil
+		}
+		select {
+		case <-exited:
+			// Either it failed, or lost the race to another helper; try that one
+			if client, err := dialDaemon(base, opts); err == nil {
+				return client, nil
+			}
+			return nil, fmt.Errorf("background helper exited; see %s", daemonLogPath(rootDir))
+		case <-deadline:
+			return nil, fmt.Errorf("background helper did not start; see %s", daemonLogPath(rootDir))
+		case <-time.After(200 * time.Millisecond):
+		}
+	}
+}
+
+func dialDaemon(base string, opts ClientOptions) (*RecallClient, error) {
+	conn, err := daemonDial(base)
+	if err != nil {
+		return nil, err
+	}
+	return &RecallClient{
+		opts:   opts,
+		conn:   conn,
+		reader: bufio.NewReader(conn),
+		writer: conn,
+		done:   make(chan struct{}),
+	}, nil
+}
+
+// startDaemon launches "jb-recall daemon" with this command's flags, so it
+// derives the same options, detached from the terminal. The returned
+// channel is closed if it exits.
+func startDaemon(rootDir string, args []string) (<-chan struct{}, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(rootDir, 0755); err != nil {
+		return nil, err
+	}
+	logFile, err := os.OpenFile(daemonLogPath(rootDir), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	defer logFile.Close()
+
+	cmd := exec.Command(exe, append([]string{"daemon"}, args[2:]...)...)
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	cmd.SysProcAttr = detachAttrs()
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start background helper: %w", err)
+	}
+	exited := make(chan struct{})
+	go func() {
+		cmd.Wait()
+		close(exited)
+	}()
+	return exited, nil
+}
+
+// runDaemon serves CLI clients on the socket until it has been idle for
+// idle, or is signalled. With watch it also keeps directories indexed (see
+// watch.go) and, having work of its own, never exits for being idle.
+// SIGHUP rereads the config, which can change what is watched.
+func runDaemon(rootDir string, opts ClientOptions, idle time.Duration, watch *watchOptions, reloader *configReloader) error {
+	base := daemonBase(rootDir, opts)
+	unlock, err := lockFile(base + ".lock")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	client, err := NewRecallClient(rootDir, opts)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	// Holding the lock means no live helper owns a leftover endpoint
+	ln, err := daemonListen(base)
+	if err != nil {
+		return err
+	}
+	logger.Info(fmt.Sprintf("%s daemon listening on %s (idle timeout %s)", time.Now().Format(time.RFC3339), ln.Addr(), idle),
+		"addr", ln.Addr().String(), "idle_timeout", idle.String())
+
+	// Connections report in and out so the idle timer only runs while no
+	// client is connected. On the way out no more are accepted, open ones
+	// are hung up on, and their relays finish before the Python client is
+	// closed under them.
+	activity := make(chan int)
+	quit := make(chan struct{})
+	var (
+		relays  sync.WaitGroup
+		connsMu sync.Mutex
+		conns   = make(map[net.Conn]bool)
+		closing bool
+	)
+	defer func() {
+		close(quit)
+		ln.Close()
+		connsMu.Lock()
+		closing = true
+		for conn := range conns {
+			conn.Close()
+		}
+		connsMu.Unlock()
+		relays.Wait()
+	}()
+	report := func(n int) {
+		select {
+		case activity <- n:
+		case <-quit:
+		}
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			connsMu.Lock()
+			if closing {
+				connsMu.Unlock()
+				conn.Close()
+				return
+			}
+			conns[conn] = true
+			relays.Add(1)
+			connsMu.Unlock()
+			report(1)
+			go func() {
+				defer relays.Done()
+				relay(client, conn)
+				connsMu.Lock()
+				delete(conns, conn)
+				connsMu.Unlock()
+				report(-1)
+			}()
+		}
+	}()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	timer := time.NewTimer(idle)
+	// Buffered so a reload doesn't wait out a watch pass in progress
+	updates := make(chan *watchOptions, 1)
+	if watch != nil {
+		timer.Stop()
+		logWatching(watch)
+		go watchDirs(ctx, client, rootDir, watch, updates)
+	}
+	active := 0
+	for {
+		select {
+		case n := <-activity:
+			active += n
+			timer.Stop()
+			if active == 0 && watch == nil {
+				timer.Reset(idle)
+			}
+		case <-timer.C:
+			logger.Info(fmt.Sprintf("%s idle for %s, exiting", time.Now().Format(time.RFC3339), idle), "idle_timeout", idle.String())
+			return nil
+		case <-hup:
+			cfg, err := reloader.load()
+			if err == nil && watch != nil {
+				var w *watchOptions
+				if w, err = newWatchOptions(cfg, reloader.args, opts); err == nil {
+					logWatching(w)
+					// Replace an update the watcher hasn't taken yet
+					select {
+					case <-updates:
+					default:
+					}
+					updates <- w
+				}
+			}
+			if err != nil {
+				logger.Warn(fmt.Sprintf("Reload failed, keeping the current config: %v", err), "error", err.Error())
+			} else {
+				logger.Info("Reloaded "+reloader.path, "path", reloader.path)
+			}
+		case <-client.done:
+			return errors.New("python process exited")
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+func logWatching(w *watchOptions) {
+	logger.Info(fmt.Sprintf("Watching %d directories every %s", len(w.dirs), w.interval), "dirs", w.dirs, "interval", w.interval.String())
+}
+
+// relay forwards one CLI connection's requests to Python, one at a time,
+// passing back every response message (several for a streamed search).
+//
+// Python holds one database, collection and mode at a time, which other
+// connections or a watch pass may switch between this connection's init
+// and its later requests, so the init is sent again ahead of each of them
+// under the same lock.
+func relay(client *RecallClient, conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	var init *Message
+	for {
+		line, err := r.ReadBytes('\n')
+		if err != nil {
+			return
+		}
+		var msg Message
+		if json.Unmarshal(line, &msg) != nil {
+			continue
+		}
+		// The helper outlives its clients
+		if msg.Cmd == "quit" {
+			return
+		}
+		if msg.Cmd == "init" {
+			init = &msg
+		}
+
+		client.mu.Lock()
+		if init != nil && msg.Cmd != "init" {
+			var resp *Message
+			if err = client.send(*init); err == nil {
+				resp, err = client.recv()
+			}
+			// Without its own database the request can't run; answer
+			// with the reason instead
+			if err == nil && resp.Status == "error" {
+				data, _ := json.Marshal(resp)
+				conn.Write(append(data, '\n'))
+				client.mu.Unlock()
+				continue
+			}
+		}
+		if err == nil {
+			err = client.send(msg)
+		}
+		for err == nil {
+			var resp *Message
+			if resp, err = client.recv(); err != nil {
+				break
+			}
+			// Keep reading even if the client has gone, so the next
+			// request doesn't see this one's responses
+			data, _ := json.Marshal(resp)
+			conn.Write(append(data, '\n'))
+			if resp.Status != "result" {
+				break
+			}
+		}
+		client.mu.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
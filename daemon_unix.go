@@ -0,0 +1,40 @@
+//go:build !windows
+
+package main
+
+import (
+	"net"
+	"os"
+	"syscall"
+)
+
+// detachAttrs starts the helper in its own session so it survives the
+// terminal that launched it.
+func detachAttrs() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{Setsid: true}
+}
+
+// lockFile takes an exclusive lock on path, released by the returned func
+// or when the process exits.
+func lockFile(path string) (func(), error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		return nil, errDaemonRunning
+	}
+	return func() { f.Close() }, nil
+}
+
+// daemonListen listens on a Unix socket, which like the rest of the root
+// directory is only reachable by its owner.
+func daemonListen(base string) (net.Listener, error) {
+	os.Remove(base + ".sock")
+	return net.Listen("unix", base+".sock")
+}
+
+func daemonDial(base string) (net.Conn, error) {
+	return net.Dial("unix", base+".sock")
+}
@@ -0,0 +1,132 @@
+//go:build windows
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Windows has no flock or Setsid, and Unix sockets only on recent builds,
+// so the helper listens on a loopback TCP port instead. The port and a
+// random token go in <base>.addr, readable only by the user like the rest
+// of the root directory; any other local process that connects is dropped
+// unless its first line is the token.
+
+// syscall doesn't export these.
+const (
+	detachedProcess       = 0x00000008 // DETACHED_PROCESS
+	errorSharingViolation = syscall.Errno(32)
+)
+
+// detachAttrs starts the helper without a console, in its own process
+// group so the launching terminal's Ctrl-C doesn't reach it.
+func detachAttrs() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{CreationFlags: syscall.CREATE_NEW_PROCESS_GROUP | detachedProcess}
+}
+
+// lockFile opens path with no sharing, which fails while another process
+// has it open and is released when this one exits.
+func lockFile(path string) (func(), error) {
+	name, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return nil, err
+	}
+	h, err := syscall.CreateFile(name, syscall.GENERIC_READ|syscall.GENERIC_WRITE, 0, nil,
+		syscall.OPEN_ALWAYS, syscall.FILE_ATTRIBUTE_NORMAL, 0)
+	if err != nil {
+		if errors.Is(err, errorSharingViolation) {
+			return nil, errDaemonRunning
+		}
+		return nil, err
+	}
+	return func() { syscall.CloseHandle(h) }, nil
+}
+
+func daemonListen(base string) (net.Listener, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, err
+	}
+	token := hex.EncodeToString(buf)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(base+".addr", []byte(ln.Addr().String()+" "+token+"\n"), 0600); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return &tokenListener{Listener: ln, token: token, path: base + ".addr"}, nil
+}
+
+func daemonDial(base string) (net.Conn, error) {
+	data, err := os.ReadFile(base + ".addr")
+	if err != nil {
+		return nil, err
+	}
+	addr, token, ok := strings.Cut(strings.TrimSpace(string(data)), " ")
+	if !ok {
+		return nil, fmt.Errorf("malformed %s.addr", base)
+	}
+	conn, err := net.DialTimeout("tcp", addr, time.Second)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := fmt.Fprintln(conn, token); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// tokenListener only hands out connections that open with the token.
+type tokenListener struct {
+	net.Listener
+	token string
+	path  string
+}
+
+func (l *tokenListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if l.authenticate(conn) {
+			return conn, nil
+		}
+		conn.Close()
+	}
+}
+
+// authenticate reads the first line a byte at a time, so nothing after it
+// is consumed before the relay reads the connection.
+func (l *tokenListener) authenticate(conn net.Conn) bool {
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	defer conn.SetReadDeadline(time.Time{})
+	var line []byte
+	b := make([]byte, 1)
+	for len(line) <= len(l.token) {
+		if _, err := conn.Read(b); err != nil {
+			return false
+		}
+		if b[0] == '\n' {
+			return strings.TrimSpace(string(line)) == l.token
+		}
+		line = append(line, b[0])
+	}
+	return false
+}
+
+func (l *tokenListener) Close() error {
+	os.Remove(l.path)
+	return l.Listener.Close()
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Messages are newline-delimited JSON by default. With --framing length
+// each message is instead a 4-byte big-endian length followed by that many
+// bytes of JSON (the layout jumpboot's msgpack transport uses), so very
+// large payloads never depend on line buffering. Python advertises the
+// framings it supports in its ready message and the switch is made with a
+// "framing" command, answered in the old framing.
+const (
+	framingNewline = "newline"
+	framingLength  = "length"
+)
+
+// maxFrameSize guards against a corrupt length prefix allocating gigabytes.
+const maxFrameSize = 256 << 20
+
+func writeFrame(w io.Writer, data []byte) error {
+	var header [4]byte
+	binary.BigEndian.PutUint32(header[:], uint32(len(data)))
+	if _, err := w.Write(header[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+func readFrame(r io.Reader) ([]byte, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(header[:])
+	if n > maxFrameSize {
+		return nil, fmt.Errorf("frame of %d bytes exceeds the %d byte limit", n, maxFrameSize)
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(r, data); err != nil {
+		// The header promised a body, so running out here is never a
+		// clean end of the stream
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return data, nil
+}
+
+// negotiateFraming switches the connection to the requested framing if
+// Python offered it in ready. Newline framing needs no negotiation.
+func (c *RecallClient) negotiateFraming(ready *Message, framing string) error {
+	switch framing {
+	case "", framingNewline:
+		return nil
+	case framingLength:
+	default:
+		return fmt.Errorf("unknown framing %q (want newline or length)", framing)
+	}
+	if !contains(ready.Framings, framing) {
+		return fmt.Errorf("the Python side does not support %s framing", framing)
+	}
+	resp, err := c.call(Message{Cmd: "framing", Framing: framing})
+	if err != nil {
+		return err
+	}
+	if resp.Status != "ok" {
+		return fmt.Errorf("framing negotiation failed: %s", resp.Error)
+	}
+	c.framed = true
+	return nil
+}
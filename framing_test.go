@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestFrameRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", []byte{}},
+		{"json", []byte(`{"cmd":"stats"}`)},
+		{"newlines", []byte("{\"text\":\"a\nb\"}\n\n")},
+		{"large", bytes.Repeat([]byte("x"), 1<<20)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := writeFrame(&buf, tt.data); err != nil {
+				t.Fatalf("writeFrame: %v", err)
+			}
+			if got := buf.Len(); got != 4+len(tt.data) {
+				t.Fatalf("wrote %d bytes, want %d", got, 4+len(tt.data))
+			}
+			got, err := readFrame(&buf)
+			if err != nil {
+				t.Fatalf("readFrame: %v", err)
+			}
+			if !bytes.Equal(got, tt.data) {
+				t.Errorf("read back %d bytes that differ from the %d written", len(got), len(tt.data))
+			}
+		})
+	}
+}
+
+func TestFramesInSequence(t *testing.T) {
+	var buf bytes.Buffer
+	messages := []string{`{"n":1}`, "", `{"n":3}`}
+	for _, m := range messages {
+		if err := writeFrame(&buf, []byte(m)); err != nil {
+			t.Fatalf("writeFrame: %v", err)
+		}
+	}
+	for _, want := range messages {
+		got, err := readFrame(&buf)
+		if err != nil {
+			t.Fatalf("readFrame: %v", err)
+		}
+		if string(got) != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+	}
+	if _, err := readFrame(&buf); err != io.EOF {
+		t.Errorf("after the last frame got %v, want io.EOF", err)
+	}
+}
+
+// header is a length prefix as writeFrame lays it out.
+func header(n uint32) []byte {
+	h := make([]byte, 4)
+	binary.BigEndian.PutUint32(h, n)
+	return h
+}
+
+func TestReadFrameErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   []byte
+		wantErr error  // matched with errors.Is, if set
+		wantMsg string // contained in the error, if set
+	}{
+		{"no input", nil, io.EOF, ""},
+		{"one header byte", []byte{0}, io.ErrUnexpectedEOF, ""},
+		{"three header bytes", []byte{0, 0, 1}, io.ErrUnexpectedEOF, ""},
+		{"missing body", header(10), io.ErrUnexpectedEOF, ""},
+		{"truncated body", append(header(10), "abcd"...), io.ErrUnexpectedEOF, ""},
+		{"one past the limit", header(maxFrameSize + 1), nil, "exceeds the 268435456 byte limit"},
+		{"largest length", header(1<<32 - 1), nil, "frame of 4294967295 bytes"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := readFrame(bytes.NewReader(tt.input))
+			if err == nil {
+				t.Fatalf("got %d bytes and no error", len(data))
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Errorf("got %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantMsg != "" && !strings.Contains(err.Error(), tt.wantMsg) {
+				t.Errorf("got %q, want it to contain %q", err, tt.wantMsg)
+			}
+		})
+	}
+}
+
+// shortWriter fails once it has taken limit bytes.
+type shortWriter struct {
+	limit int
+	buf   bytes.Buffer
+}
+
+var errWriteFailed = errors.New("write failed")
+
+func (w *shortWriter) Write(p []byte) (int, error) {
+	if w.buf.Len()+len(p) > w.limit {
+		return 0, errWriteFailed
+	}
+	return w.buf.Write(p)
+}
+
+func TestWriteFrameErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		limit int
+	}{
+		{"header", 0},
+		{"body", 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := &shortWriter{limit: tt.limit}
+			if err := writeFrame(w, []byte(`{"cmd":"stats"}`)); !errors.Is(err, errWriteFailed) {
+				t.Errorf("got %v, want %v", err, errWriteFailed)
+			}
+		})
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+)
+
+// Diagnostics (startup progress, warnings, server and daemon lifecycle) go
+// to stderr through logger. Messages are written for people and printed as
+// is by default; with --log-format json each becomes one JSON object with
+// the message's values also under "fields", for journald or ELK.
+var logger = slog.New(textHandler{})
+
+// logLevel is Info, or Warn with --quiet, which leaves out progress such as
+// "Database ready" for scripts; --verbose keeps the default.
+var logLevel = new(slog.LevelVar)
+
+func setQuiet(quiet bool) {
+	if quiet {
+		logLevel.Set(slog.LevelWarn)
+	} else {
+		logLevel.Set(slog.LevelInfo)
+	}
+}
+
+func setLogFormat(format string) error {
+	switch format {
+	case "", "text":
+		logger = slog.New(textHandler{})
+	case "json":
+		h := slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{
+			Level: logLevel,
+			ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+				if len(groups) == 0 {
+					switch a.Key {
+					case slog.TimeKey:
+						a.Key = "timestamp"
+					case slog.MessageKey:
+						a.Key = "message"
+					}
+				}
+				return a
+			},
+		})
+		logger = slog.New(h.WithGroup("fields"))
+	default:
+		return fmt.Errorf("unknown log format %q (want text or json)", format)
+	}
+	return nil
+}
+
+// textHandler prints just the message, as the CLI always has.
+type textHandler struct{}
+
+func (textHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= logLevel.Level()
+}
+
+func (textHandler) Handle(_ context.Context, r slog.Record) error {
+	prefix := ""
+	if r.Level == slog.LevelWarn {
+		prefix = "Warning: "
+	}
+	_, err := fmt.Fprintf(os.Stderr, "%s%s\n", prefix, r.Message)
+	return err
+}
+
+func (h textHandler) WithAttrs([]slog.Attr) slog.Handler { return h }
+func (h textHandler) WithGroup(string) slog.Handler      { return h }
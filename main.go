@@ -5,11 +5,20 @@ import (
 	_ "embed"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unicode"
 
 	"github.com/richinsley/jumpboot"
 )
@@ -19,82 +28,454 @@ var recallScript string
 
 const envName = "jb-recall"
 const pythonVersion = "3.11"
+const defaultChannel = "conda-forge"
+
+// envAttempts is how many times environment creation is tried when it
+// fails with what looks like a transient network error.
+const envAttempts = 3
+
+// previewChars is how much of each chunk search output shows by default.
+const previewChars = 300
+
+// budgetFetchLimit is how many results a --budget search asks for; the
+// character budget, not the count, decides how many are kept.
+const budgetFetchLimit = 50
+
+// Index runs estimated above either threshold ask for confirmation first.
+const (
+	confirmFiles  = 5000
+	confirmChunks = 50000
+)
 
 type RecallClient struct {
-	process *jumpboot.PythonProcess
-	reader  *bufio.Reader
-	writer  io.Writer
+	opts      ClientOptions
+	process   *jumpboot.PythonProcess
+	reader    *bufio.Reader
+	writer    io.Writer
+	mu        sync.Mutex    // serializes call round trips
+	done      chan struct{} // closed once the Python process exits
+	closeOnce sync.Once
+	framed    bool     // length-prefixed framing; see framing.go
+	conn      net.Conn // set instead of process when talking to a daemon
 }
 
 type Message struct {
-	Cmd        string   `json:"cmd,omitempty"`
-	Status     string   `json:"status,omitempty"`
-	Error      string   `json:"error,omitempty"`
-	Reason     string   `json:"reason,omitempty"`
-	Path       string   `json:"path,omitempty"`
-	DbPath     string   `json:"db_path,omitempty"`
-	Query      string   `json:"query,omitempty"`
-	Limit      int      `json:"limit,omitempty"`
-	Force      bool     `json:"force,omitempty"`
-	Extensions []string `json:"extensions,omitempty"`
-	Count      int      `json:"count,omitempty"`
-	Indexed    int      `json:"indexed,omitempty"`
-	Skipped    int      `json:"skipped,omitempty"`
-	Chunks     int      `json:"chunks,omitempty"`
-	Results    []Result `json:"results,omitempty"`
+	Cmd        string    `json:"cmd,omitempty"`
+	Status     string    `json:"status,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	Reason     string    `json:"reason,omitempty"`
+	Path       string    `json:"path,omitempty"`
+	ChunkID    string    `json:"chunk_id,omitempty"`
+	DbPath     string    `json:"db_path,omitempty"`
+	Query      string    `json:"query,omitempty"`
+	Limit      int       `json:"limit,omitempty"`
+	Force      bool      `json:"force,omitempty"`
+	Extensions []string  `json:"extensions,omitempty"`
+	Count      int       `json:"count,omitempty"`
+	Indexed    int       `json:"indexed,omitempty"`
+	Skipped    int       `json:"skipped,omitempty"`
+	Chunks     int       `json:"chunks,omitempty"`
+	Trashed    int       `json:"trashed,omitempty"`
+	Results    []Result  `json:"results,omitempty"`
+	Text       string    `json:"text,omitempty"`
+	Embedding  []float64 `json:"embedding,omitempty"`
+	Model      string    `json:"model,omitempty"`
+	Backend    string    `json:"backend,omitempty"`
+	Dimension  int       `json:"dimension,omitempty"`
+	Warnings   []string  `json:"warnings,omitempty"`
+
+	HnswEfConstruction int                `json:"hnsw_ef_construction,omitempty"`
+	HnswM              int                `json:"hnsw_m,omitempty"`
+	EfSearch           int                `json:"ef_search,omitempty"`
+	QueryMs            float64            `json:"query_ms,omitempty"`
+	LikeIDs            []string           `json:"like_ids,omitempty"`
+	UnlikeIDs          []string           `json:"unlike_ids,omitempty"`
+	FollowSymlinks     bool               `json:"follow_symlinks,omitempty"`
+	Snippets           bool               `json:"snippets,omitempty"`
+	Stream             bool               `json:"stream,omitempty"`
+	Collection         string             `json:"collection,omitempty"`
+	SizeBefore         int64              `json:"size_before,omitempty"`
+	SizeAfter          int64              `json:"size_after,omitempty"`
+	Tags               []string           `json:"tags,omitempty"`
+	Tag                string             `json:"tag,omitempty"`
+	Under              string             `json:"under,omitempty"`
+	Offset             int                `json:"offset,omitempty"`
+	Framing            string             `json:"framing,omitempty"`
+	Framings           []string           `json:"framings,omitempty"`
+	Preprocess         []Preprocessor     `json:"preprocess,omitempty"`
+	Name               string             `json:"name,omitempty"`
+	QueryPrefix        string             `json:"query_prefix,omitempty"`
+	PassagePrefix      string             `json:"passage_prefix,omitempty"`
+	AsQuery            bool               `json:"as_query,omitempty"`
+	Docs               int                `json:"docs,omitempty"`
+	Queries            int                `json:"queries,omitempty"`
+	Bench              *BenchStats        `json:"bench,omitempty"`
+	Fields             []string           `json:"fields,omitempty"`
+	NoText             bool               `json:"no_text,omitempty"`
+	ChunkIDs           string             `json:"chunk_ids,omitempty"`
+	MaxDepth           *int               `json:"max_depth,omitempty"` // nil walks the whole tree
+	Fix                bool               `json:"fix,omitempty"`
+	Mail               bool               `json:"mail,omitempty"`
+	Archives           bool               `json:"archives,omitempty"`
+	ReadOnly           bool               `json:"read_only,omitempty"`
+	Anomalies          map[string]int     `json:"anomalies,omitempty"`
+	Removed            int                `json:"removed,omitempty"`
+	Expected           int                `json:"expected,omitempty"`
+	MaxTextBytes       int                `json:"max_text_bytes,omitempty"`
+	HalfLife           float64            `json:"half_life,omitempty"` // days; recency boost if set
+	ScoreWeights       map[string]float64 `json:"score_weights,omitempty"`
+	KeywordMode        string             `json:"keyword_mode,omitempty"`
+	Source             string             `json:"source,omitempty"`
+	Dest               string             `json:"dest,omitempty"`
+	Overwrite          bool               `json:"overwrite,omitempty"`
+	Resume             bool               `json:"resume,omitempty"`
+	Resumed            int                `json:"resumed,omitempty"`
+	OnlyNew            bool               `json:"only_new,omitempty"`
+	Present            int                `json:"present,omitempty"`
+	Replaced           int                `json:"replaced,omitempty"`
+	ReuseEmbeddings    bool               `json:"reuse_embeddings,omitempty"`
+	Reused             int                `json:"reused,omitempty"`
+	Embedded           int                `json:"embedded,omitempty"`
+	Encoding           string             `json:"encoding,omitempty"`
+	Frontmatter        string             `json:"frontmatter,omitempty"`
+	ChunkStrategy      map[string]string  `json:"chunk_strategy,omitempty"`
+	Header             *ScoreHeader       `json:"header,omitempty"`
+	ExternalChunks     []ExternalChunk    `json:"external_chunks,omitempty"`
+	MaxConcurrentFiles int                `json:"max_concurrent_files,omitempty"`
+}
+
+// ExternalChunk is one line of index --stdin-jsonl: text the caller already
+// chunked, stored under Path as-is with Meta as extra metadata.
+type ExternalChunk struct {
+	Text string         `json:"text"`
+	Path string         `json:"path"`
+	Meta map[string]any `json:"meta,omitempty"`
+}
+
+// ScoreHeader comes with search results so JSON consumers know what the
+// scores mean without assuming a model or metric.
+type ScoreHeader struct {
+	Model          string `json:"model"`
+	Metric         string `json:"metric"` // the collection's distance metric, e.g. cosine
+	Score          string `json:"score"`  // how score derives from distance
+	HigherIsBetter bool   `json:"higher_is_better"`
 }
 
 type Result struct {
-	ID       string  `json:"id"`
-	Score    float64 `json:"score"`
-	Text     string  `json:"text"`
-	Path     string  `json:"path"`
-	Filename string  `json:"filename"`
-	ChunkIdx int     `json:"chunk_idx"`
+	ID         string  `json:"id"`
+	Score      float64 `json:"score"`
+	Text       string  `json:"text"`
+	Path       string  `json:"path"`
+	Filename   string  `json:"filename"`
+	ChunkIdx   int     `json:"chunk_idx"`
+	FileSize   int64   `json:"file_size,omitempty"`
+	FileChunks int     `json:"file_chunks,omitempty"`
+	Snippet    string  `json:"snippet,omitempty"`
+	Tags       string  `json:"tags,omitempty"`
+	Mtime      float64 `json:"mtime,omitempty"`
+	IndexedAt  string  `json:"indexed_at,omitempty"` // RFC 3339
+	Subject    string  `json:"subject,omitempty"`
+	Sender     string  `json:"sender,omitempty"`
+	Cite       string  `json:"cite,omitempty"` // set by --cite, not stored
+	// ChunkEnd is the last chunk of a result --merge-adjacent merged from
+	// several, starting at ChunkIdx; not stored
+	ChunkEnd int `json:"chunk_end,omitempty"`
+	// TextTruncated marks text cut short, or left out, to keep the response
+	// within --max-results-text-bytes
+	TextTruncated bool   `json:"text_truncated,omitempty"`
+	RelPath       string `json:"rel_path,omitempty"`
+	// Title and Date come from markdown frontmatter, if indexed with it
+	Title string `json:"title,omitempty"`
+	Date  string `json:"date,omitempty"`
+}
+
+// resultFields are the keys of a Result, which --fields picks from.
+var resultFields = []string{
+	"id", "score", "text", "path", "filename", "chunk_idx", "file_size", "file_chunks",
+	"snippet", "tags", "mtime", "indexed_at", "rel_path", "subject", "sender", "cite", "text_truncated",
+	"chunk_end", "title", "date",
+}
+
+// noTextFields are what json --no-text returns: enough to pick results and
+// fetch their text later.
+var noTextFields = []string{"id", "score", "path", "filename", "chunk_idx"}
+
+// checkFields rejects names that aren't result fields.
+func checkFields(fields []string) error {
+	for _, f := range fields {
+		if !contains(resultFields, f) {
+			return fmt.Errorf("unknown field %q (want %s)", f, strings.Join(resultFields, ", "))
+		}
+	}
+	return nil
+}
+
+// withFields returns resp for JSON output with each result cut down to
+// fields. Python already leaves the rest out, but Result would otherwise
+// reintroduce them as zero values.
+func withFields(resp *Message, fields []string) any {
+	if len(fields) == 0 {
+		return resp
+	}
+	data, _ := json.Marshal(resp)
+	var out map[string]any
+	json.Unmarshal(data, &out)
+	if results, ok := out["results"].([]any); ok {
+		for _, r := range results {
+			m, _ := r.(map[string]any)
+			for k := range m {
+				if !contains(fields, k) {
+					delete(m, k)
+				}
+			}
+		}
+	}
+	return out
+}
+
+// BenchStats is what the bench command measures.
+type BenchStats struct {
+	Docs          int     `json:"docs"`
+	Chunks        int     `json:"chunks"`
+	Queries       int     `json:"queries"`
+	IndexSeconds  float64 `json:"index_seconds"`
+	DocsPerSec    float64 `json:"docs_per_sec"`
+	ChunksPerSec  float64 `json:"chunks_per_sec"`
+	QueriesPerSec float64 `json:"queries_per_sec"`
+	P50Ms         float64 `json:"p50_ms"`
+	P95Ms         float64 `json:"p95_ms"`
+}
+
+// ClientOptions configures how NewRecallClient sets up the Python side.
+type ClientOptions struct {
+	Channel string // conda channel used to create the environment
+	Backend string // embedding backend, a key of backendPackages
+	Threads int    // CPU threads for embedding; 0 leaves the library default
+
+	// Collection is the Chroma collection to use; "" means the default
+	Collection string
+
+	// NoInstall skips pip installs for pre-provisioned environments
+	NoInstall bool
+
+	// Verbose reports protocol noise that is normally skipped silently
+	Verbose bool
+
+	// Framing is the wire framing, newline (default) or length
+	Framing string
+
+	// QueryPrefix and PassagePrefix are prepended to queries and indexed
+	// text, for instruction-tuned models such as E5 ("query: ", "passage: ")
+	QueryPrefix   string
+	PassagePrefix string
+
+	// Script, if set, is a recall.py on disk to run instead of the embedded
+	// copy, for working on the Python side without rebuilding
+	Script string
+
+	// ReadOnly makes Python refuse every command that changes the index
+	ReadOnly bool
+
+	// MaxTextBytes bounds the result text in one search response; 0 for no cap
+	MaxTextBytes int
+
+	// HNSW parameters: construction-time ones apply when the collection is
+	// created, EfSearch is stored on it by index runs; 0 leaves it as it is
+	HnswEfConstruction int
+	HnswM              int
+	EfSearch           int
+}
+
+const defaultBackend = "sentence-transformers"
+
+// backendPackages lists what each embedding backend needs installed.
+// fastembed runs the same model on ONNX, avoiding the multi-gigabyte torch.
+var backendPackages = map[string][]string{
+	"sentence-transformers": {"sentence-transformers", "chromadb", "torch"},
+	"fastembed":             {"fastembed", "chromadb"},
+}
+
+// documentPackages extract text from document formats, whichever backend
+// is in use. They're recorded as installed under documentsKey, so existing
+// environments pick them up on their next run.
+var documentPackages = []string{"python-docx"}
+
+const documentsKey = "documents"
+
+// installedBackendsPath records which backends' packages are in the environment.
+func installedBackendsPath(rootDir string) string {
+	return filepath.Join(rootDir, "installed_backends.json")
+}
+
+// loadInstalledBackends returns the backends installed in the environment.
+// Environments that predate the record were set up for sentence-transformers.
+func loadInstalledBackends(rootDir string, isNewEnv bool) []string {
+	if isNewEnv {
+		return nil
+	}
+	data, err := os.ReadFile(installedBackendsPath(rootDir))
+	if err != nil {
+		return []string{defaultBackend}
+	}
+	var backends []string
+	if json.Unmarshal(data, &backends) != nil {
+		return []string{defaultBackend}
+	}
+	return backends
+}
+
+func saveInstalledBackends(rootDir string, backends []string) {
+	data, _ := json.Marshal(backends)
+	os.WriteFile(installedBackendsPath(rootDir), data, 0644)
+}
+
+// networkErrorHints are fragments of the errors micromamba and the Go HTTP
+// client report when a channel or download host can't be reached.
+var networkErrorHints = []string{
+	"no such host",
+	"could not resolve",
+	"temporary failure in name resolution",
+	"connection refused",
+	"connection reset",
+	"network is unreachable",
+	"timed out",
+	"timeout",
+	"tls handshake",
+	"download error",
+	"curl error",
+}
+
+// isNetworkError reports whether err looks like a connectivity problem.
+// jumpboot flattens underlying errors into strings, so this matches text.
+func isNetworkError(err error) bool {
+	msg := strings.ToLower(err.Error())
+	for _, hint := range networkErrorHints {
+		if strings.Contains(msg, hint) {
+			return true
+		}
+	}
+	return false
+}
+
+// createEnvironment creates or reuses the conda environment, retrying with
+// backoff when the channel is unreachable.
+func createEnvironment(rootDir, channel string) (*jumpboot.PythonEnvironment, error) {
+	envPath := filepath.Join(rootDir, "envs", envName)
+	_, statErr := os.Stat(envPath)
+	existed := statErr == nil
+
+	delay := 2 * time.Second
+	for attempt := 1; ; attempt++ {
+		env, err := jumpboot.CreateEnvironmentMamba(envName, rootDir, pythonVersion, channel, nil)
+		if err == nil {
+			return env, nil
+		}
+		if !isNetworkError(err) {
+			return nil, fmt.Errorf("failed to create environment: %w", err)
+		}
+		if attempt == envAttempts {
+			return nil, fmt.Errorf("could not reach conda channel %q after %d attempts: %w\n"+
+				"Check your network connection, or use --channel (or \"channel\" in config.json) "+
+				"to point at a reachable mirror", channel, envAttempts, err)
+		}
+
+		logger.Warn(fmt.Sprintf("Network error creating environment (attempt %d/%d), retrying in %s: %v",
+			attempt, envAttempts, delay, err), "attempt", attempt, "delay", delay.String(), "error", err.Error())
+		// Don't let a half-created environment pass for a finished one
+		if !existed {
+			os.RemoveAll(envPath)
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
 }
 
-func NewRecallClient(rootDir string) (*RecallClient, error) {
+func NewRecallClient(rootDir string, opts ClientOptions) (*RecallClient, error) {
 	// Create or use existing environment
-	env, err := jumpboot.CreateEnvironmentMamba(envName, rootDir, pythonVersion, "conda-forge", nil)
+	env, err := createEnvironment(rootDir, opts.Channel)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create environment: %w", err)
+		return nil, err
+	}
+
+	packages, ok := backendPackages[opts.Backend]
+	if !ok {
+		return nil, fmt.Errorf("unknown embedding backend %q (want sentence-transformers or fastembed)", opts.Backend)
 	}
 
-	// Install dependencies if new environment
-	if env.IsNew {
-		fmt.Fprintln(os.Stderr, "Installing dependencies (first run, may take a few minutes)...")
-		err = env.PipInstallPackages([]string{"sentence-transformers", "chromadb", "torch"}, "", "", false, nil)
+	// Install dependencies if new environment, or if this backend hasn't
+	// been installed into it yet
+	installed := loadInstalledBackends(rootDir, env.IsNew)
+	if !opts.NoInstall && !contains(installed, opts.Backend) {
+		logger.Info(fmt.Sprintf("Installing %s dependencies (may take a few minutes)...", opts.Backend), "backend", opts.Backend)
+		err = env.PipInstallPackages(packages, "", "", false, nil)
 		if err != nil {
 			return nil, fmt.Errorf("failed to install packages: %w", err)
 		}
+		installed = append(installed, opts.Backend)
+		saveInstalledBackends(rootDir, installed)
+	}
+	// Document extractors are optional, so a failed install only means
+	// those formats get skipped
+	if !opts.NoInstall && !contains(installed, documentsKey) {
+		logger.Info("Installing document extractors...", "packages", strings.Join(documentPackages, ","))
+		if err := env.PipInstallPackages(documentPackages, "", "", false, nil); err != nil {
+			logger.Warn(fmt.Sprintf("could not install %s: %v", strings.Join(documentPackages, ", "), err), "error", err.Error())
+		} else {
+			saveInstalledBackends(rootDir, append(installed, documentsKey))
+		}
 	}
 
-	// Create program with embedded script
+	// Create program with embedded script, or the one on disk if given
 	cwd, _ := os.Getwd()
+	script, scriptPath := recallScript, filepath.Join(cwd, "recall.py")
+	if opts.Script != "" {
+		data, err := os.ReadFile(opts.Script)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read script: %w", err)
+		}
+		script, scriptPath = string(data), opts.Script
+		logger.Info("Using Python script "+opts.Script, "script", opts.Script)
+	}
 	program := &jumpboot.PythonProgram{
 		Name: "jb-recall",
 		Path: cwd,
 		Program: jumpboot.Module{
 			Name:   "__main__",
-			Path:   filepath.Join(cwd, "recall.py"),
-			Source: base64.StdEncoding.EncodeToString([]byte(recallScript)),
+			Path:   scriptPath,
+			Source: base64.StdEncoding.EncodeToString([]byte(script)),
 		},
 	}
 
+	// Bound the thread pools torch/ONNX and the BLAS libraries size from these
+	var envVars map[string]string
+	if opts.Threads > 0 {
+		n := strconv.Itoa(opts.Threads)
+		envVars = map[string]string{
+			"OMP_NUM_THREADS":      n,
+			"MKL_NUM_THREADS":      n,
+			"OPENBLAS_NUM_THREADS": n,
+		}
+	}
+
 	// Start Python process
-	process, _, err := env.NewPythonProcessFromProgram(program, nil, nil, false)
+	process, _, err := env.NewPythonProcessFromProgram(program, envVars, nil, false)
 	if err != nil {
 		return nil, fmt.Errorf("failed to start Python process: %w", err)
 	}
 
 	client := &RecallClient{
+		opts:    opts,
 		process: process,
 		reader:  bufio.NewReader(process.PipeIn),
 		writer:  process.PipeOut,
+		done:    make(chan struct{}),
 	}
 
-	// Forward stderr
-	go io.Copy(os.Stderr, process.Stderr)
+	// Forward stderr; it reaches EOF when the process exits
+	go func() {
+		io.Copy(os.Stderr, process.Stderr)
+		close(client.done)
+	}()
 
 	// Wait for ready
 	resp, err := client.recv()
@@ -106,6 +487,23 @@ func NewRecallClient(rootDir string) (*RecallClient, error) {
 		process.Terminate()
 		return nil, fmt.Errorf("unexpected status: %s", resp.Status)
 	}
+	if err := client.negotiateFraming(resp, opts.Framing); err != nil {
+		client.Close()
+		return nil, err
+	}
+
+	// Nothing was installed, so make sure the environment really has what
+	// the backend needs rather than failing later on an import error
+	if opts.NoInstall {
+		resp, err := client.call(Message{Cmd: "check", Backend: opts.Backend})
+		if err == nil && resp.Status == "error" {
+			err = fmt.Errorf("%s (automatic installation is disabled by --no-install/JB_RECALL_NO_INSTALL)", resp.Error)
+		}
+		if err != nil {
+			client.Close()
+			return nil, err
+		}
+	}
 
 	return client, nil
 }
@@ -115,23 +513,125 @@ func (c *RecallClient) send(msg Message) error {
 	if err != nil {
 		return err
 	}
+	if c.framed {
+		return writeFrame(c.writer, data)
+	}
 	_, err = c.writer.Write(append(data, '\n'))
 	return err
 }
 
+// recv reads the next protocol message. Every message Python sends has a
+// status, so anything else on the pipe (blank lines, a stray print, JSON
+// from a library) is skipped, and reported with --verbose.
 func (c *RecallClient) recv() (*Message, error) {
-	line, err := c.reader.ReadString('\n')
+	for {
+		line, err := c.readMessage()
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimPrefix(strings.TrimSpace(line), "\ufeff")
+		if line == "" {
+			continue
+		}
+		var msg Message
+		if json.Unmarshal([]byte(line), &msg) != nil || msg.Status == "" {
+			if c.opts.Verbose {
+				logger.Info("Ignoring non-protocol output from Python: "+line, "output", line)
+			}
+			continue
+		}
+		return &msg, nil
+	}
+}
+
+// readMessage reads the raw text of the next message in the current framing.
+func (c *RecallClient) readMessage() (string, error) {
+	if c.framed {
+		data, err := readFrame(c.reader)
+		return string(data), err
+	}
+	return c.reader.ReadString('\n')
+}
+
+// call sends msg and waits for its response. It is safe for concurrent use.
+func (c *RecallClient) call(msg Message) (*Message, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.send(msg); err != nil {
+		return nil, err
+	}
+	return c.recv()
+}
+
+// stream sends msg and calls fn for each result Python streams back, one
+// message per result. It returns the final message that ends the stream.
+func (c *RecallClient) stream(msg Message, fn func(Result)) (*Message, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.send(msg); err != nil {
+		return nil, err
+	}
+	for {
+		resp, err := c.recv()
+		if err != nil || resp.Status != "result" {
+			return resp, err
+		}
+		for _, r := range resp.Results {
+			fn(r)
+		}
+	}
+}
+
+// Alive reports whether the Python process is still running.
+func (c *RecallClient) Alive() bool {
+	select {
+	case <-c.done:
+		return false
+	default:
+		return true
+	}
+}
+
+// initDatabase opens the collection under rootDir, applying any
+// creation-time options from c.opts.
+func (c *RecallClient) initDatabase(rootDir string) (*Message, error) {
+	resp, err := c.call(c.initMessage(rootDir))
 	if err != nil {
 		return nil, err
 	}
-	var msg Message
-	err = json.Unmarshal([]byte(line), &msg)
-	return &msg, err
+	if resp.Status == "error" {
+		return nil, errors.New(resp.Error)
+	}
+	return resp, nil
+}
+
+// initMessage opens the database and collection these options select.
+func (c *RecallClient) initMessage(rootDir string) Message {
+	return Message{
+		Cmd:                "init",
+		DbPath:             filepath.Join(rootDir, "db"),
+		Backend:            c.opts.Backend,
+		Collection:         c.opts.Collection,
+		QueryPrefix:        c.opts.QueryPrefix,
+		PassagePrefix:      c.opts.PassagePrefix,
+		ReadOnly:           c.opts.ReadOnly,
+		MaxTextBytes:       c.opts.MaxTextBytes,
+		HnswEfConstruction: c.opts.HnswEfConstruction,
+		HnswM:              c.opts.HnswM,
+		EfSearch:           c.opts.EfSearch,
+	}
 }
 
 func (c *RecallClient) Close() {
-	c.send(Message{Cmd: "quit"})
-	c.process.Terminate()
+	c.closeOnce.Do(func() {
+		// A daemon's Python process is shared; just hang up
+		if c.conn != nil {
+			c.conn.Close()
+			return
+		}
+		c.send(Message{Cmd: "quit"})
+		c.process.Terminate()
+	})
 }
 
 func main() {
@@ -140,147 +640,1933 @@ func main() {
 		os.Exit(1)
 	}
 
-	cmd := os.Args[1]
-
 	// Root directory for jb-recall
 	homeDir, _ := os.UserHomeDir()
 	rootDir := filepath.Join(homeDir, ".jb-recall")
+	if v, ok := flagValue(os.Args, "--root"); ok {
+		// The Python side runs from its environment, so make it absolute
+		rootDir, _ = filepath.Abs(v)
+	}
+
+	// A saved query runs as the search it was saved from
+	if os.Args[1] == "saved" {
+		os.Args = savedSearchArgs(rootDir, os.Args)
+	}
+
+	cmd := os.Args[1]
+	verbose := contains(os.Args, "--verbose")
 
-	// Create client
-	client, err := NewRecallClient(rootDir)
+	configPath, explicit := flagValue(os.Args, "--config")
+	if !explicit {
+		configPath = filepath.Join(rootDir, "config.json")
+	}
+	cfg, err := loadConfig(configPath, explicit)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 		os.Exit(1)
 	}
-	defer client.Close()
-
-	// Initialize database
-	dbPath := filepath.Join(rootDir, "db")
-	client.send(Message{Cmd: "init", DbPath: dbPath})
-	initResp, err := client.recv()
-	if err != nil || initResp.Status == "error" {
-		fmt.Fprintf(os.Stderr, "Init error: %v %s\n", err, initResp.Error)
+	logFormat, ok := flagValue(os.Args, "--log-format")
+	if !ok {
+		logFormat = cfg.LogFormat
+	}
+	if err := setLogFormat(logFormat); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	if contains(os.Args, "--quiet") && verbose {
+		fmt.Fprintln(os.Stderr, "Error: --quiet and --verbose can't be combined")
 		os.Exit(1)
 	}
-	fmt.Fprintf(os.Stderr, "Database ready (%d chunks indexed)\n", initResp.Count)
+	setQuiet(contains(os.Args, "--quiet"))
+	opts := clientOptions(rootDir, cfg, os.Args)
+	reloader := &configReloader{rootDir: rootDir, path: configPath, required: explicit, args: os.Args, opts: opts}
 
-	switch cmd {
-	case "index":
-		if len(os.Args) < 3 {
-			fmt.Fprintln(os.Stderr, "Usage: jb-recall index <path>")
+	// The server manages its own client so it can answer probes during startup
+	if cmd == "serve" {
+		addr, ok := flagValue(os.Args, "--addr")
+		if !ok {
+			addr = defaultServeAddr
+		}
+		var idle time.Duration
+		if v, ok := flagValue(os.Args, "--idle-timeout"); ok {
+			if idle, err = time.ParseDuration(v); err != nil || idle < 0 {
+				fmt.Fprintln(os.Stderr, "Error: --idle-timeout must be a duration such as 30m, or 0 for never")
+				os.Exit(1)
+			}
+		}
+		if err := serve(rootDir, addr, opts, cfg.maxLimit(), reloader, idle); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 			os.Exit(1)
 		}
-		path := os.Args[2]
-		absPath, _ := filepath.Abs(path)
-		info, err := os.Stat(absPath)
+		return
+	}
+
+	// history only reads a local file; no need to start Python
+	if cmd == "history" {
+		entries, err := loadHistory(rootDir, intFlag(os.Args, "--limit", 20))
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 			os.Exit(1)
 		}
+		if len(entries) == 0 {
+			fmt.Println("No queries yet.")
+		}
+		for _, e := range entries {
+			fmt.Printf("%s  %-7s  %3d results  %s\n", e.Time.Local().Format("2006-01-02 15:04"), e.Command, e.Results, e.Query)
+		}
+		return
+	}
 
-		force := contains(os.Args, "--force")
-
-		if info.IsDir() {
-			client.send(Message{Cmd: "index_dir", Path: absPath, Force: force})
+	// use only reads or writes a state file
+	if cmd == "use" {
+		names := positional(os.Args[2:])
+		switch {
+		case contains(os.Args, "--clear"):
+			err = useCollection(rootDir, "")
+		case len(names) == 1:
+			err = useCollection(rootDir, names[0])
+		case len(names) == 0:
+			if current := currentCollection(rootDir); current != "" {
+				fmt.Println(current)
+			} else {
+				fmt.Println("memory (the default; choose another with jb-recall use <collection>)")
+			}
+			return
+		default:
+			fmt.Fprintln(os.Stderr, "Usage: jb-recall use [<collection> | --clear]")
+			os.Exit(1)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		if len(names) == 1 {
+			fmt.Printf("Now using collection %s (override with --collection)\n", names[0])
 		} else {
-			client.send(Message{Cmd: "index_file", Path: absPath, Force: force})
+			fmt.Println("Back to the default collection")
 		}
+		return
+	}
 
-		resp, err := client.recv()
+	if cmd == "daemon" {
+		idle := time.Duration(intFlag(os.Args, "--daemon-idle", int(defaultDaemonIdle/time.Second))) * time.Second
+		var watch *watchOptions
+		if contains(os.Args, "--watch") {
+			if watch, err = newWatchOptions(cfg, os.Args, opts); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(1)
+			}
+		}
+		if err := runDaemon(rootDir, opts, idle, watch, reloader); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	// Fail before starting Python; recall.py refuses these too, which also
+	// covers the server and a shared daemon
+	writes := readOnlyBlocked[cmd] || cmd == "verify" && contains(os.Args, "--fix")
+	name := cmd
+	if cmd == "verify" {
+		name = "verify --fix"
+	}
+	if opts.ReadOnly && writes {
+		fmt.Fprintf(os.Stderr, "Error: read-only mode: %s is disabled\n", name)
+		os.Exit(1)
+	}
+	// Likewise a database Python couldn't open, or couldn't write to, which
+	// would otherwise fail somewhere inside Chroma. --dry-run only reads.
+	write := writes && !contains(os.Args, "--dry-run")
+	if err := checkDBAccess(filepath.Join(rootDir, "db"), write, !indexReaders[cmd]); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s: %v\n", name, err)
+		os.Exit(1)
+	}
+
+	// Create client, via the warm background helper if asked to
+	var client *RecallClient
+	if contains(os.Args, "--daemon") || cfg.Daemon {
+		client, err = connectDaemon(rootDir, opts, os.Args)
+		if err != nil {
+			logger.Warn(fmt.Sprintf("%v; running without it", err), "error", err.Error())
+		}
+	}
+	if client == nil {
+		client, err = NewRecallClient(rootDir, opts)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	defer client.Close()
+
+	// Shut down cleanly on Ctrl-C/SIGTERM so Python finishes its current
+	// write instead of being orphaned mid-index
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		logger.Info("Interrupted, shutting down...")
+		client.Close()
+		os.Exit(1)
+	}()
+
+	// Setup is all prefetch is for; leave the database alone
+	if cmd == "prefetch" {
+		resp, err := client.call(Message{Cmd: "prefetch", Backend: opts.Backend})
+		if err == nil && resp.Status == "error" {
+			err = errors.New(resp.Error)
+		}
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 			os.Exit(1)
 		}
+		fmt.Printf("Environment ready: %s (%s, %d dimensions) is cached\n", resp.Model, resp.Backend, resp.Dimension)
+		return
+	}
 
-		if resp.Status == "error" {
-			fmt.Fprintf(os.Stderr, "Error: %s\n", resp.Error)
+	// Initialize database
+	initResp, err := client.initDatabase(rootDir)
+	if err != nil {
+		logger.Error(fmt.Sprintf("Init error: %v", err), "error", err.Error())
+		os.Exit(1)
+	}
+	printWarnings(initResp)
+	if opts.Collection != "" {
+		logger.Info(fmt.Sprintf("Database ready (%d chunks indexed in %s)", initResp.Count, opts.Collection),
+			"chunks", initResp.Count, "collection", opts.Collection)
+	} else {
+		logger.Info(fmt.Sprintf("Database ready (%d chunks indexed)", initResp.Count), "chunks", initResp.Count)
+	}
+
+	switch cmd {
+	case "index":
+		paths := positional(os.Args[2:])
+		if contains(os.Args, "--stdin-jsonl") {
+			if len(paths) > 0 {
+				fmt.Fprintln(os.Stderr, "Error: --stdin-jsonl reads chunks from stdin and takes no paths")
+				os.Exit(1)
+			}
+			indexStdinJSONL(client, cfg, os.Args)
+			return
+		}
+		if len(paths) == 0 {
+			fmt.Fprintln(os.Stderr, "Usage: jb-recall index <path>...")
 			os.Exit(1)
 		}
 
-		if info.IsDir() {
-			fmt.Printf("Indexed %d files (%d skipped)\n", resp.Indexed, resp.Skipped)
-		} else {
-			fmt.Printf("Status: %s\n", resp.Status)
-			if resp.Chunks > 0 {
-				fmt.Printf("Chunks: %d\n", resp.Chunks)
+		// Resolve every path up front so a typo fails before any indexing starts
+		absPaths := make([]string, len(paths))
+		infos := make([]os.FileInfo, len(paths))
+		for i, path := range paths {
+			absPaths[i], _ = filepath.Abs(path)
+			info, err := os.Stat(absPaths[i])
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(1)
 			}
+			infos[i] = info
 		}
 
-	case "search", "query", "q":
-		if len(os.Args) < 3 {
-			fmt.Fprintln(os.Stderr, "Usage: jb-recall search <query>")
-			os.Exit(1)
+		// With --archives, an archive is indexed entry by entry, like a
+		// directory
+		archives := contains(os.Args, "--archives")
+		asDir := make([]bool, len(paths))
+		for i, info := range infos {
+			asDir[i] = info.IsDir() || archives && isArchive(absPaths[i])
 		}
-		query := strings.Join(os.Args[2:], " ")
 
-		client.send(Message{Cmd: "search", Query: query, Limit: 5})
-		resp, err := client.recv()
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		// A logical name stands in for one file's path, so it can't apply to
+		// several files or a directory
+		name, hasName := flagValue(os.Args, "--name")
+		if hasName && (len(paths) != 1 || asDir[0] || name == "") {
+			fmt.Fprintln(os.Stderr, "Error: --name needs exactly one file to index")
 			os.Exit(1)
 		}
 
-		if resp.Status == "error" {
-			fmt.Fprintf(os.Stderr, "Error: %s\n", resp.Error)
-			os.Exit(1)
+		followSymlinks := contains(os.Args, "--follow-symlinks")
+		mail := contains(os.Args, "--mail")
+		var maxDepth *int
+		if _, ok := flagValue(os.Args, "--max-depth"); ok {
+			n := intFlag(os.Args, "--max-depth", 0)
+			if n < 0 {
+				fmt.Fprintln(os.Stderr, "Error: --max-depth can't be negative")
+				os.Exit(1)
+			}
+			maxDepth = &n
 		}
 
-		if len(resp.Results) == 0 {
-			fmt.Println("No results found.")
-		} else {
-			for i, r := range resp.Results {
-				fmt.Printf("\n--- Result %d (%.2f) ---\n", i+1, r.Score)
-				fmt.Printf("File: %s\n", r.Filename)
-				fmt.Printf("Path: %s\n", r.Path)
-				text := r.Text
-				if len(text) > 300 {
-					text = text[:300] + "..."
+		// Enumerate first: --dry-run stops there, and big runs ask before starting
+		dryRun := contains(os.Args, "--dry-run")
+		if dryRun || !contains(os.Args, "--yes") {
+			files, estimated, err := scanPaths(client, absPaths, followSymlinks, mail, archives, maxDepth)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(1)
+			}
+			if dryRun {
+				fmt.Printf("Would index %d files (~%d chunks)\n", files, estimated)
+				return
+			}
+			if files > confirmFiles || estimated > confirmChunks {
+				// Scripts can't answer the prompt, so say how to proceed
+				// rather than declining on their behalf
+				if !stdinIsTerminal() {
+					fmt.Fprintf(os.Stderr, "Error: indexing %d files (~%d chunks) needs confirmation above %d files or %d chunks, "+
+						"and stdin is not a terminal; --yes is required to index without asking\n",
+						files, estimated, confirmFiles, confirmChunks)
+					os.Exit(1)
+				}
+				if !confirm(fmt.Sprintf("About to index %d files (~%d chunks). Continue?", files, estimated)) {
+					fmt.Fprintln(os.Stderr, "Aborted.")
+					os.Exit(1)
 				}
-				fmt.Printf("Content:\n%s\n", text)
 			}
 		}
 
-	case "stats":
-		client.send(Message{Cmd: "stats"})
-		resp, _ := client.recv()
-		fmt.Printf("Indexed chunks: %d\n", resp.Count)
-
-	case "clear":
-		client.send(Message{Cmd: "clear"})
-		client.recv()
-		fmt.Println("Database cleared.")
+		force := contains(os.Args, "--force")
+		onlyNew := contains(os.Args, "--only-new")
+		if force && onlyNew {
+			fmt.Fprintln(os.Stderr, "Error: --force and --only-new can't be combined")
+			os.Exit(1)
+		}
+		strategies, err := chunkStrategies(cfg, os.Args)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		tags := listFlag(os.Args, "--tag")
+		preprocess := preprocessors(cfg, os.Args)
+		idScheme, err := chunkIDsFlag(cfg, os.Args)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
 
-	case "json":
-		if len(os.Args) < 3 {
-			fmt.Fprintln(os.Stderr, "Usage: jb-recall json <query>")
+		reuse := contains(os.Args, "--reuse-embeddings")
+		concurrent := intFlag(os.Args, "--max-concurrent-files", 1)
+		if concurrent < 1 {
+			fmt.Fprintf(os.Stderr, "Error: --max-concurrent-files must be at least 1, got %d\n", concurrent)
+			os.Exit(1)
+		}
+		encoding, _ := flagValue(os.Args, "--encoding")
+		frontmatter, err := frontmatterFlag(cfg, os.Args)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 			os.Exit(1)
 		}
-		query := strings.Join(os.Args[2:], " ")
-		client.send(Message{Cmd: "search", Query: query, Limit: 10})
-		resp, _ := client.recv()
-		output, _ := json.MarshalIndent(resp, "", "  ")
-		fmt.Println(string(output))
 
-	default:
-		printUsage()
-		os.Exit(1)
-	}
-}
+		var indexed, skipped, chunks, trashed, replaced, present, reused, embedded int
+		var lastStatus, lastReason string
+		for i, absPath := range absPaths {
+			msg := Message{
+				Cmd:             "index_file",
+				Path:            absPath,
+				Force:           force,
+				ChunkStrategy:   strategies,
+				Tags:            tags,
+				Preprocess:      preprocess,
+				Name:            name,
+				ChunkIDs:        idScheme,
+				ReuseEmbeddings: reuse,
+				Encoding:        encoding,
+				Frontmatter:     frontmatter,
+			}
+			if asDir[i] {
+				msg.Cmd = "index_dir"
+				msg.FollowSymlinks = followSymlinks
+				msg.Mail = mail
+				msg.Archives = archives
+				msg.MaxDepth = maxDepth
+				msg.OnlyNew = onlyNew
+				msg.MaxConcurrentFiles = concurrent
+			}
+			client.send(msg)
 
-func printUsage() {
-	fmt.Println(`jb-recall - Semantic memory layer
+			resp, err := client.recv()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(1)
+			}
 
-Usage:
-  jb-recall index <path>     Index a file or directory
-  jb-recall search <query>   Search indexed content
-  jb-recall stats            Show database statistics
-  jb-recall clear            Clear the database
-  jb-recall json <query>     Search and output JSON (for integration)
+			if resp.Status == "error" {
+				fmt.Fprintf(os.Stderr, "Error: %s\n", resp.Error)
+				os.Exit(1)
+			}
 
-Examples:
-  jb-recall index ~/clawd/memory
+			if asDir[i] {
+				indexed += resp.Indexed
+				skipped += resp.Skipped
+				present += resp.Present
+			} else if resp.Status == "indexed" {
+				indexed++
+			} else {
+				skipped++
+			}
+			chunks += resp.Chunks
+			trashed += resp.Trashed
+			replaced += resp.Replaced
+			reused += resp.Reused
+			embedded += resp.Embedded
+			lastStatus, lastReason = resp.Status, resp.Reason
+		}
+
+		if len(paths) == 1 && !asDir[0] {
+			if lastReason != "" {
+				fmt.Printf("Status: %s (%s)\n", lastStatus, lastReason)
+			} else {
+				fmt.Printf("Status: %s\n", lastStatus)
+			}
+			if chunks > 0 {
+				fmt.Printf("Chunks: %d\n", chunks)
+			}
+			if replaced > 0 {
+				fmt.Printf("Replaced: %d previous chunks\n", replaced)
+			}
+		} else {
+			fmt.Printf("Indexed %d files (%d skipped, %d chunks)\n", indexed, skipped, chunks)
+		}
+		if reuse && reused+embedded > 0 {
+			fmt.Printf("Reused %d chunk embeddings; re-embedded %d\n", reused, embedded)
+		}
+		if onlyNew {
+			fmt.Printf("Added %d new files; %d were already indexed\n", indexed, present)
+		}
+		if trashed > 0 {
+			fmt.Printf("Moved %d deleted files to trash (undo with: jb-recall restore <path>)\n", trashed)
+		}
+		if indexed == 0 && contains(os.Args, "--fail-on-empty") {
+			fmt.Fprintln(os.Stderr, "Error: nothing was indexed")
+			os.Exit(1)
+		}
+
+	case "search", "query", "q":
+		query := strings.Join(positional(os.Args[2:]), " ")
+		chunkID, byID := flagValue(os.Args, "--by-id")
+		// Filters without a query are a plain listing; nothing to embed
+		if query == "" && !byID && hasListFilters(os.Args) {
+			listChunks(client, os.Args, cfg.maxLimit())
+			return
+		}
+		if query == "" && !byID {
+			fmt.Fprintln(os.Stderr, "Usage: jb-recall search <query> | --by-id <chunk-id>")
+			os.Exit(1)
+		}
+
+		budget := intFlag(os.Args, "--budget", 0)
+		minScore := floatFlag(os.Args, "--min-score", 0)
+		limit, preview := limitFlag(os.Args, 5, cfg.maxLimit(), false), previewFlag(cfg, os.Args)
+		if budget > 0 {
+			limit, preview = budgetFetchLimit, 0
+		}
+		msg := Message{Cmd: "search", Query: query, Limit: limit, Snippets: contains(os.Args, "--snippet")}
+		weights, err := scoreWeightsFlag(os.Args)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		if weights != nil && contains(os.Args, "--recency-boost") {
+			fmt.Fprintln(os.Stderr, "Error: --recency-boost can't be combined with --score-weights; weight recency there instead")
+			os.Exit(1)
+		}
+		if _, ok := weights["recency"]; ok || contains(os.Args, "--recency-boost") {
+			msg.HalfLife = halfLifeFlag(cfg, os.Args)
+		}
+		msg.ScoreWeights = weights
+		if mode, ok := flagValue(os.Args, "--keyword-mode"); ok {
+			if !contains(keywordModes, mode) {
+				fmt.Fprintf(os.Stderr, "Error: --keyword-mode must be one of %s\n", strings.Join(keywordModes, ", "))
+				os.Exit(1)
+			}
+			if byID {
+				fmt.Fprintln(os.Stderr, "Error: --keyword-mode needs a query to match; --by-id has none")
+				os.Exit(1)
+			}
+			msg.KeywordMode = mode
+		}
+		if byID {
+			msg.Cmd, msg.Query, msg.ChunkID = "search_by_id", "", chunkID
+		}
+
+		// Human output prints each result as Python streams it; the other
+		// modes need the whole set first
+		sortBy, _ := flagValue(os.Args, "--sort")
+		if sortBy != "" && !contains(sortKeys, sortBy) {
+			fmt.Fprintf(os.Stderr, "Error: --sort must be one of %s\n", strings.Join(sortKeys, ", "))
+			os.Exit(1)
+		}
+		display := resultDisplay(os.Args)
+		showTime := verbose || contains(os.Args, "--show-time")
+		mergeChunks := contains(os.Args, "--merge-adjacent")
+		streaming := !byID && msg.KeywordMode == "" && budget == 0 && (sortBy == "" || sortBy == "score") && !mergeChunks &&
+			!contains(os.Args, "--files-only") && !contains(os.Args, "--oneline")
+		var resp *Message
+		var streamed []Result
+		fetched := 0
+		if streaming {
+			msg.Stream = true
+			resp, err = client.stream(msg, func(r Result) {
+				fetched++
+				// Results arrive best first, so everything after is lower too
+				if r.Score < minScore {
+					return
+				}
+				if display != nil {
+					r = display(r)
+				}
+				streamed = append(streamed, r)
+				printResult(len(streamed), r, verbose, showTime, preview)
+			})
+		} else {
+			resp, err = client.call(msg)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+
+		if resp.Status == "error" {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", resp.Error)
+			os.Exit(1)
+		}
+		if !streaming {
+			fetched = len(resp.Results)
+		}
+		resp.Results = aboveScore(resp.Results, minScore)
+		scored := len(resp.Results)
+		if mergeChunks {
+			resp.Results = mergeAdjacent(resp.Results)
+		}
+		if budget > 0 {
+			resp.Results = withinBudget(resp.Results, budget)
+		}
+		sortResults(resp.Results, sortBy)
+		if display != nil && !streaming {
+			for i := range resp.Results {
+				resp.Results[i] = display(resp.Results[i])
+			}
+		}
+
+		if streaming {
+			resp.Results = streamed
+			if len(streamed) == 0 {
+				printResults(nil, verbose, showTime, preview)
+			}
+		} else if contains(os.Args, "--files-only") {
+			for _, path := range uniquePaths(resp.Results) {
+				fmt.Println(path)
+			}
+		} else if contains(os.Args, "--oneline") {
+			printOneline(resp.Results, preview)
+		} else {
+			printResults(resp.Results, verbose, showTime, preview)
+		}
+		if streaming {
+			scored = len(streamed)
+		}
+		if len(resp.Results) == 0 {
+			explainNoResults(client, initResp.Count, fetched, scored, minScore, budget)
+		}
+		printWarnings(resp)
+		if verbose {
+			printQueryStats(resp)
+		}
+		// refine re-embeds the query text, which a --by-id search doesn't have
+		if !byID {
+			saveLastSearch(rootDir, query, resp.Results)
+			appendHistory(rootDir, "search", query, len(resp.Results))
+		}
+		if name, ok := flagValue(os.Args, "--save-query"); ok {
+			if err := saveQuery(rootDir, name, os.Args[2:]); err != nil {
+				fmt.Fprintf(os.Stderr, "Error saving query: %v\n", err)
+				os.Exit(1)
+			}
+			fmt.Fprintf(os.Stderr, "Saved as %q (run it with: jb-recall saved %s)\n", name, name)
+		}
+
+	case "refine":
+		last, err := loadLastSearch(rootDir)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error: no previous search to refine (run jb-recall search first)")
+			os.Exit(1)
+		}
+		query := strings.Join(positional(os.Args[2:]), " ")
+		if query == "" {
+			query = last.Query
+		}
+		resp, err := refineSearch(client, last, query, os.Args)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		if display := resultDisplay(os.Args); display != nil {
+			for i := range resp.Results {
+				resp.Results[i] = display(resp.Results[i])
+			}
+		}
+		printResults(resp.Results, verbose, verbose || contains(os.Args, "--show-time"), previewFlag(cfg, os.Args))
+		printWarnings(resp)
+		if verbose {
+			printQueryStats(resp)
+		}
+		saveLastSearch(rootDir, query, resp.Results)
+		appendHistory(rootDir, "refine", query, len(resp.Results))
+
+	case "stats":
+		resp, err := client.call(Message{Cmd: "stats"})
+		if err == nil && resp.Status == "error" {
+			err = errors.New(resp.Error)
+		}
+		// A failed call must not read as an empty index, least of all in --json
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		// The counts as data, for scripts that would otherwise scrape
+		// "Database ready" from stderr
+		if contains(os.Args, "--json") {
+			output, _ := json.MarshalIndent(Message{Count: resp.Count, Trashed: resp.Trashed, Collection: opts.Collection}, "", "  ")
+			fmt.Println(string(output))
+			return
+		}
+		fmt.Printf("Indexed chunks: %d\n", resp.Count)
+		if resp.Trashed > 0 {
+			fmt.Printf("In trash: %d\n", resp.Trashed)
+		}
+
+	case "restore":
+		paths := positional(os.Args[2:])
+		if len(paths) != 1 {
+			fmt.Fprintln(os.Stderr, "Usage: jb-recall restore <path>")
+			os.Exit(1)
+		}
+		absPath, _ := filepath.Abs(paths[0])
+		client.send(Message{Cmd: "restore", Path: absPath})
+		resp, err := client.recv()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		if resp.Status == "error" {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", resp.Error)
+			os.Exit(1)
+		}
+		fmt.Printf("Restored %d chunks.\n", resp.Count)
+
+	case "empty-trash":
+		client.send(Message{Cmd: "empty_trash"})
+		resp, err := client.recv()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		if resp.Status == "error" {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", resp.Error)
+			os.Exit(1)
+		}
+		fmt.Printf("Permanently removed %d chunks.\n", resp.Count)
+
+	case "clear":
+		client.send(Message{Cmd: "clear"})
+		client.recv()
+		fmt.Println("Database cleared.")
+
+	case "list", "list-chunks":
+		listChunks(client, os.Args, cfg.maxLimit())
+
+	case "count":
+		countChunks(client, os.Args)
+
+	case "remove":
+		tag, ok := flagValue(os.Args, "--tag")
+		if !ok || tag == "" {
+			fmt.Fprintln(os.Stderr, "Usage: jb-recall remove --tag <tag>")
+			os.Exit(1)
+		}
+		resp, err := client.call(Message{Cmd: "remove", Tag: tag})
+		if err == nil && resp.Status == "error" {
+			err = errors.New(resp.Error)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Removed %d chunks tagged %q\n", resp.Count, tag)
+
+	case "bench":
+		docs := intFlag(os.Args, "--docs", 200)
+		queries := intFlag(os.Args, "--queries", 50)
+		fmt.Fprintf(os.Stderr, "Benchmarking %d synthetic documents and %d searches...\n", docs, queries)
+		resp, err := client.call(Message{Cmd: "bench", Docs: docs, Queries: queries})
+		if err == nil && resp.Status == "error" {
+			err = errors.New(resp.Error)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		b := resp.Bench
+		fmt.Printf("Backend:   %s\n", opts.Backend)
+		fmt.Printf("Indexing:  %d docs, %d chunks in %.2fs\n", b.Docs, b.Chunks, b.IndexSeconds)
+		fmt.Printf("           %.1f docs/sec, %.1f chunks/sec\n", b.DocsPerSec, b.ChunksPerSec)
+		fmt.Printf("Searching: %d queries, %.1f queries/sec\n", b.Queries, b.QueriesPerSec)
+		fmt.Printf("Latency:   p50 %.1f ms, p95 %.1f ms\n", b.P50Ms, b.P95Ms)
+
+	case "compact":
+		resp, err := client.call(Message{Cmd: "compact", DbPath: filepath.Join(rootDir, "db")})
+		if err == nil && resp.Status == "error" {
+			err = errors.New(resp.Error)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Compacted %d chunks: %s -> %s\n", resp.Count, formatSize(resp.SizeBefore), formatSize(resp.SizeAfter))
+
+	case "reindex":
+		strategies, err := chunkStrategies(cfg, os.Args)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		idScheme, err := chunkIDsFlag(cfg, os.Args)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		resp, err := client.call(Message{
+			Cmd:           "reindex",
+			Resume:        contains(os.Args, "--resume"),
+			ChunkStrategy: strategies,
+			Preprocess:    preprocessors(cfg, os.Args),
+			ChunkIDs:      idScheme,
+		})
+		if err == nil && resp.Status == "error" {
+			err = errors.New(resp.Error)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		if resp.Resumed > 0 {
+			fmt.Printf("Resumed after %d of %d files\n", resp.Resumed, resp.Count)
+		}
+		fmt.Printf("Re-indexed %d files (%d skipped, %d chunks)\n", resp.Indexed, resp.Skipped, resp.Chunks)
+
+	case "copy-collection":
+		names := positional(os.Args[2:])
+		if len(names) != 2 {
+			fmt.Fprintln(os.Stderr, "Usage: jb-recall copy-collection <source> <dest> [--overwrite]")
+			os.Exit(1)
+		}
+		resp, err := client.call(Message{Cmd: "copy_collection", Source: names[0], Dest: names[1], Overwrite: contains(os.Args, "--overwrite")})
+		if err == nil && resp.Status == "error" {
+			err = errors.New(resp.Error)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Copied %d chunks from %s to %s\n", resp.Count, names[0], names[1])
+
+	case "verify":
+		fix := contains(os.Args, "--fix")
+		resp, err := client.call(Message{Cmd: "verify", Fix: fix})
+		if err == nil && resp.Status == "error" {
+			err = errors.New(resp.Error)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Checked %d chunks\n", resp.Count)
+		total := 0
+		for _, a := range verifyAnomalies {
+			fmt.Printf("  %-22s %d\n", a.label, resp.Anomalies[a.key])
+			total += resp.Anomalies[a.key]
+		}
+		// What the files were indexed with against what actually got stored
+		if resp.Expected != resp.Chunks || resp.Chunks != resp.Count {
+			fmt.Printf("Per-file totals add up to %d chunks, but the collection holds %d (%d read back)\n", resp.Expected, resp.Chunks, resp.Count)
+		} else {
+			fmt.Printf("Per-file totals match the collection's %d chunks\n", resp.Chunks)
+		}
+		switch {
+		case fix:
+			fmt.Printf("Removed %d chunks.\n", resp.Removed)
+		case total > 0:
+			fmt.Println("Run jb-recall verify --fix to remove them (re-index to restore files that still exist).")
+		}
+
+	case "json":
+		query := strings.Join(positional(os.Args[2:]), " ")
+		if query == "" {
+			fmt.Fprintln(os.Stderr, "Usage: jb-recall json <query>")
+			os.Exit(1)
+		}
+		fields := listFlag(os.Args, "--fields")
+		if err := checkFields(fields); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		noText := contains(os.Args, "--no-text")
+		if noText {
+			if len(fields) > 0 {
+				fmt.Fprintln(os.Stderr, "Error: --no-text and --fields can't be combined")
+				os.Exit(1)
+			}
+			fields = noTextFields
+		}
+		resp, err := client.call(Message{Cmd: "search", Query: query, Limit: 10, Fields: fields, NoText: noText})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		if resp.Status == "error" {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", resp.Error)
+			os.Exit(1)
+		}
+		if contains(os.Args, "--cite") {
+			for i := range resp.Results {
+				resp.Results[i] = withCitation(resp.Results[i])
+			}
+		}
+		var output []byte
+		if contains(os.Args, "--compact") {
+			output, _ = json.Marshal(withFields(resp, fields))
+		} else {
+			output, _ = json.MarshalIndent(withFields(resp, fields), "", "  ")
+		}
+		fmt.Println(string(output))
+
+	case "context":
+		query := strings.Join(positional(os.Args[2:]), " ")
+		if query == "" {
+			fmt.Fprintln(os.Stderr, "Usage: jb-recall context <query> [--limit n] [--budget chars]")
+			os.Exit(1)
+		}
+		resp, err := client.call(Message{
+			Cmd:   "search",
+			Query: query,
+			Limit: limitFlag(os.Args, 10, cfg.maxLimit(), false),
+		})
+		if err == nil && resp.Status == "error" {
+			err = errors.New(resp.Error)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		results := dedupeResults(resp.Results)
+		if contains(os.Args, "--cite") {
+			for i := range results {
+				results[i] = withCitation(results[i])
+			}
+		}
+		if budget := intFlag(os.Args, "--budget", 0); budget > 0 {
+			results = withinBudget(results, budget)
+		}
+		fmt.Print(contextBlock(results))
+		appendHistory(rootDir, "context", query, len(results))
+		printWarnings(resp)
+
+	case "embed":
+		// Text from the arguments, else (or with --stdin) from stdin
+		text := strings.Join(positional(os.Args[2:]), " ")
+		if text == "" || contains(os.Args, "--stdin") {
+			data, err := io.ReadAll(os.Stdin)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(1)
+			}
+			text = strings.TrimSpace(string(data))
+		}
+		if text == "" {
+			fmt.Fprintln(os.Stderr, "Usage: jb-recall embed <text> | echo <text> | jb-recall embed [--stdin]")
+			os.Exit(1)
+		}
+		client.send(Message{Cmd: "embed", Text: text, AsQuery: contains(os.Args, "--as-query")})
+		resp, err := client.recv()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		if resp.Status == "error" {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", resp.Error)
+			os.Exit(1)
+		}
+		output, _ := json.MarshalIndent(Message{Embedding: resp.Embedding, Model: resp.Model, Dimension: resp.Dimension}, "", "  ")
+		fmt.Println(string(output))
+
+	case "rpc":
+		if err := runRPC(os.Stdin, os.Stdout, recallMethods(client, cfg.maxLimit())); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+
+	case "mcp":
+		if err := runRPC(os.Stdin, os.Stdout, mcpMethods(client, cfg.maxLimit())); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+
+	default:
+		printUsage()
+		os.Exit(1)
+	}
+}
+
+// scanPaths totals the files and estimated chunks that indexing paths would
+// produce, without embedding anything.
+func scanPaths(client *RecallClient, paths []string, followSymlinks, mail, archives bool, maxDepth *int) (files, chunks int, err error) {
+	for _, path := range paths {
+		resp, err := client.call(Message{
+			Cmd: "scan", Path: path, FollowSymlinks: followSymlinks, Mail: mail, Archives: archives, MaxDepth: maxDepth,
+		})
+		if err != nil {
+			return 0, 0, err
+		}
+		if resp.Status == "error" {
+			return 0, 0, errors.New(resp.Error)
+		}
+		files += resp.Count
+		chunks += resp.Chunks
+	}
+	return files, chunks, nil
+}
+
+// readExternalChunks reads --stdin-jsonl input, one JSON chunk per line,
+// grouped by path. Paths are returned in the order they first appear.
+func readExternalChunks(r io.Reader) ([]string, map[string][]ExternalChunk, error) {
+	br := bufio.NewReader(r)
+	var paths []string
+	byPath := make(map[string][]ExternalChunk)
+	for n := 1; ; n++ {
+		line, err := br.ReadBytes('\n')
+		if len(strings.TrimSpace(string(line))) > 0 {
+			var c ExternalChunk
+			if err := json.Unmarshal(line, &c); err != nil {
+				return nil, nil, fmt.Errorf("line %d: %v", n, err)
+			}
+			if c.Path == "" {
+				return nil, nil, fmt.Errorf("line %d: path is required", n)
+			}
+			if _, ok := byPath[c.Path]; !ok {
+				paths = append(paths, c.Path)
+			}
+			byPath[c.Path] = append(byPath[c.Path], c)
+		}
+		if err == io.EOF {
+			return paths, byPath, nil
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+}
+
+// indexStdinJSONL indexes pre-chunked text from stdin. Each path's chunks go
+// in one index_chunks request, which replaces whatever that path held, so a
+// path's lines needn't be contiguous.
+func indexStdinJSONL(client *RecallClient, cfg *Config, args []string) {
+	paths, byPath, err := readExternalChunks(os.Stdin)
+	if err == nil && len(paths) == 0 {
+		err = errors.New("--stdin-jsonl read no chunks")
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	if contains(args, "--dry-run") {
+		total := 0
+		for _, chunks := range byPath {
+			total += len(chunks)
+		}
+		fmt.Printf("Would index %d paths (%d chunks)\n", len(paths), total)
+		return
+	}
+	idScheme, err := chunkIDsFlag(cfg, args)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	var indexed, skipped, chunks int
+	for _, path := range paths {
+		resp, err := client.call(Message{
+			Cmd:            "index_chunks",
+			Path:           path,
+			ExternalChunks: byPath[path],
+			Force:          contains(args, "--force"),
+			Tags:           listFlag(args, "--tag"),
+			ChunkIDs:       idScheme,
+		})
+		if err == nil && resp.Status == "error" {
+			err = fmt.Errorf("%s: %s", path, resp.Error)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		if resp.Status == "indexed" {
+			indexed++
+		} else {
+			skipped++
+		}
+		chunks += resp.Chunks
+	}
+	fmt.Printf("Indexed %d paths (%d skipped, %d chunks)\n", indexed, skipped, chunks)
+}
+
+// isArchive reports whether --archives reads path as an archive; it
+// matches is_archive in recall.py.
+func isArchive(path string) bool {
+	lower := strings.ToLower(path)
+	for _, ext := range []string{".zip", ".tar", ".tgz", ".tar.gz"} {
+		if strings.HasSuffix(lower, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkDBAccess reports whether the database directory can be used: read,
+// or with write also written, which a read-only mount or its permissions
+// can prevent. A database that doesn't exist yet is an error unless the
+// command may create it, in which case its nearest existing parent must be
+// writable.
+func checkDBAccess(dbDir string, write, create bool) error {
+	_, err := os.Stat(dbDir)
+	exists := err == nil
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if exists && !write {
+		if _, err := os.ReadDir(dbDir); err != nil {
+			return fmt.Errorf("can't read the database at %s (%v); check its permissions", dbDir, errors.Unwrap(err))
+		}
+		return nil
+	}
+	if !exists && !create {
+		return fmt.Errorf("no database at %s yet; index something first with jb-recall index <dir>", dbDir)
+	}
+
+	dir := dbDir
+	for {
+		if _, err := os.Stat(dir); err == nil {
+			break
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return nil
+		}
+		dir = parent
+	}
+	f, err := os.CreateTemp(dir, ".write-check-*")
+	if err != nil {
+		msg := fmt.Sprintf("can't write to %s; check its permissions", dir)
+		if errors.Is(err, syscall.EROFS) {
+			msg = fmt.Sprintf("can't write to %s: it is on a read-only filesystem", dir)
+		}
+		if exists {
+			msg += " (search, list and stats still work)"
+		}
+		return fmt.Errorf("%s, or use --root for a writable location", msg)
+	}
+	f.Close()
+	os.Remove(f.Name())
+	return nil
+}
+
+func stdinIsTerminal() bool {
+	info, err := os.Stdin.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// confirm asks a yes/no question on the terminal. Without a terminal there
+// is nobody to ask, so it declines quietly; the caller says what to do
+// instead.
+func confirm(prompt string) bool {
+	if !stdinIsTerminal() {
+		return false
+	}
+	fmt.Fprintf(os.Stderr, "%s [y/N] ", prompt)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+// refineSearch re-runs query with the --like/--unlike results of the last
+// search folded into the query vector.
+func refineSearch(client *RecallClient, last *Message, query string, args []string) (*Message, error) {
+	likeIDs, err := resultIDs(last.Results, args, "--like")
+	if err != nil {
+		return nil, err
+	}
+	unlikeIDs, err := resultIDs(last.Results, args, "--unlike")
+	if err != nil {
+		return nil, err
+	}
+	if len(likeIDs)+len(unlikeIDs) == 0 {
+		return nil, errors.New("usage: jb-recall refine --like <n>[,<n>...] --unlike <n>[,<n>...] [query]")
+	}
+
+	resp, err := client.call(Message{Cmd: "embed", Text: query, AsQuery: true})
+	if err != nil {
+		return nil, err
+	}
+	if resp.Status == "error" {
+		return nil, errors.New(resp.Error)
+	}
+
+	resp, err = client.call(Message{
+		Cmd:       "search_vector",
+		Embedding: resp.Embedding,
+		LikeIDs:   likeIDs,
+		UnlikeIDs: unlikeIDs,
+		Limit:     5,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if resp.Status == "error" {
+		return nil, errors.New(resp.Error)
+	}
+	return resp, nil
+}
+
+// printResults prints results for humans, cutting each chunk's text to
+// preview runes; a preview of 0 prints the text whole. showTime adds when
+// each was indexed.
+func printResults(results []Result, verbose, showTime bool, preview int) {
+	if len(results) == 0 {
+		fmt.Println("No results found.")
+		return
+	}
+	for i, r := range results {
+		printResult(i+1, r, verbose, showTime, preview)
+	}
+}
+
+// printResult prints the n-th (1-based) result; see printResults.
+func printResult(n int, r Result, verbose, showTime bool, preview int) {
+	if r.Cite != "" {
+		fmt.Printf("\n--- Result %d (%.2f) [%s] ---\n", n, r.Score, r.Cite)
+	} else {
+		fmt.Printf("\n--- Result %d (%.2f) ---\n", n, r.Score)
+	}
+	if verbose && r.FileChunks > 0 {
+		fmt.Printf("File: %s (%s, %d chunks)\n", r.Filename, formatSize(r.FileSize), r.FileChunks)
+	} else {
+		fmt.Printf("File: %s\n", r.Filename)
+	}
+	fmt.Printf("Path: %s\n", r.Path)
+	if r.Title != "" {
+		fmt.Printf("Title: %s\n", r.Title)
+	}
+	if r.Subject != "" || r.Sender != "" {
+		fmt.Printf("Mail: %s (from %s)\n", r.Subject, r.Sender)
+	}
+	if showTime && r.IndexedAt != "" {
+		if t, err := time.Parse(time.RFC3339, r.IndexedAt); err == nil {
+			fmt.Printf("Indexed: %s\n", t.Local().Format("2006-01-02 15:04"))
+		}
+	}
+	// file_chunks is the file's chunk count; older chunks may lack it
+	if r.FileChunks > 0 && r.ChunkEnd > 0 {
+		fmt.Printf("Chunks: %d-%d/%d\n", r.ChunkIdx+1, r.ChunkEnd+1, r.FileChunks)
+	} else if r.FileChunks > 0 {
+		fmt.Printf("Chunk: %d/%d\n", r.ChunkIdx+1, r.FileChunks)
+	}
+	// A snippet is the chunk's best-matching sentences, so show it whole
+	if r.Snippet != "" {
+		fmt.Printf("Snippet:\n%s\n", r.Snippet)
+	} else if preview > 0 {
+		fmt.Printf("Content:\n%s\n", truncate(r.Text, preview))
+	} else {
+		fmt.Printf("Content:\n%s\n", r.Text)
+	}
+	if r.TextTruncated {
+		fmt.Println("(text cut to fit --max-results-text-bytes)")
+	}
+}
+
+// withRelativePath shows r under its path relative to the directory it was
+// indexed from. Chunks indexed before that was recorded keep the full path.
+func withRelativePath(r Result) Result {
+	if r.RelPath != "" {
+		r.Path = r.RelPath
+	}
+	return r
+}
+
+// citeKey is a result's citation key, e.g. notes/foo.md#c3: its path
+// relative to where it was indexed (or the full path for older chunks), with
+// forward slashes, and its chunk number as search shows it (chunk_idx+1).
+func citeKey(r Result) string {
+	path := r.RelPath
+	if path == "" {
+		path = r.Path
+	}
+	return fmt.Sprintf("%s#c%d", filepath.ToSlash(path), r.ChunkIdx+1)
+}
+
+func withCitation(r Result) Result {
+	r.Cite = citeKey(r)
+	return r
+}
+
+// resultDisplay combines --cite with the path display transform, or
+// returns nil if there is nothing to do. The key is derived before paths
+// are rewritten, so it doesn't depend on --relative.
+func resultDisplay(args []string) func(Result) Result {
+	paths := pathDisplay(args)
+	if !contains(args, "--cite") {
+		return paths
+	}
+	return func(r Result) Result {
+		r = withCitation(r)
+		if paths != nil {
+			r = paths(r)
+		}
+		return r
+	}
+}
+
+// pathDisplay returns the display transform --relative, --relative-to or
+// --relative-to-cwd asks for, or nil. Only what's printed changes; stored
+// paths stay absolute.
+func pathDisplay(args []string) func(Result) Result {
+	dir, ok := flagValue(args, "--relative-to")
+	switch {
+	case contains(args, "--relative-to-cwd"):
+		dir = "."
+	case ok && !strings.HasPrefix(dir, "--"):
+	case contains(args, "--relative-to"):
+		fmt.Fprintln(os.Stderr, "Error: --relative-to needs a directory (use --relative-to-cwd for the working directory)")
+		os.Exit(1)
+	case contains(args, "--relative"):
+		return withRelativePath
+	default:
+		return nil
+	}
+	base, err := filepath.Abs(dir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	return func(r Result) Result {
+		// Logical --name paths, and paths on another drive, stay as they are
+		if filepath.IsAbs(r.Path) {
+			if rel, err := filepath.Rel(base, r.Path); err == nil {
+				r.Path = rel
+			}
+		}
+		return r
+	}
+}
+
+// aboveScore drops results scoring below min.
+func aboveScore(results []Result, min float64) []Result {
+	var kept []Result
+	for _, r := range results {
+		if r.Score >= min {
+			kept = append(kept, r)
+		}
+	}
+	return kept
+}
+
+// mergeMinOverlap is the shortest shared text mergeAdjacent drops as
+// overlap, so a chunk that merely starts with the character its neighbour
+// ends with isn't cut.
+const mergeMinOverlap = 10
+
+// mergeAdjacent turns each run of consecutive chunks of one file into a
+// single result, so overlapping chunks don't repeat text. A merged result
+// takes the place, ID and score of its best chunk, and spans ChunkIdx to
+// ChunkEnd.
+func mergeAdjacent(results []Result) []Result {
+	type chunk struct {
+		path string
+		idx  int
+	}
+	found := make(map[chunk]int, len(results))
+	for i, r := range results {
+		found[chunk{r.Path, r.ChunkIdx}] = i
+	}
+	merged := make([]Result, 0, len(results))
+	done := make([]bool, len(results))
+	for i, r := range results {
+		if done[i] {
+			continue
+		}
+		first := r.ChunkIdx
+		for {
+			if _, ok := found[chunk{r.Path, first - 1}]; !ok {
+				break
+			}
+			first--
+		}
+		m := r
+		m.ChunkIdx, m.Text = first, ""
+		for idx := first; ; idx++ {
+			j, ok := found[chunk{r.Path, idx}]
+			if !ok {
+				break
+			}
+			done[j] = true
+			m.Text = joinOverlap(m.Text, results[j].Text)
+			m.TextTruncated = m.TextTruncated || results[j].TextTruncated
+			if idx > first {
+				m.ChunkEnd = idx
+			}
+		}
+		merged = append(merged, m)
+	}
+	return merged
+}
+
+// joinOverlap appends b to a, leaving out the start of b that repeats the
+// end of a, or on a new line if they don't overlap.
+func joinOverlap(a, b string) string {
+	if a == "" {
+		return b
+	}
+	for n := min(len(a), len(b)); n >= mergeMinOverlap; n-- {
+		if strings.HasSuffix(a, b[:n]) {
+			return a + b[n:]
+		}
+	}
+	return a + "\n" + b
+}
+
+// withinBudget keeps the top results whose combined text fits in budget
+// runes, truncating the last one to use up what remains.
+func withinBudget(results []Result, budget int) []Result {
+	var kept []Result
+	for _, r := range results {
+		n := len([]rune(r.Text))
+		if n > budget {
+			// Too little room left for a meaningful partial chunk
+			if budget > len("...") {
+				r.Text = truncate(r.Text, budget-len("..."))
+				kept = append(kept, r)
+			}
+			break
+		}
+		kept = append(kept, r)
+		budget -= n
+	}
+	return kept
+}
+
+// truncate shortens text to at most limit runes, preferring to cut at the
+// last whitespace so words aren't split, and appends an ellipsis if it cut.
+func truncate(text string, limit int) string {
+	runes := []rune(text)
+	if len(runes) <= limit {
+		return text
+	}
+	cut := runes[:limit]
+	// Only back up to a word boundary if that doesn't throw away most of the text
+	for i := len(cut) - 1; i > limit/2; i-- {
+		if unicode.IsSpace(cut[i]) {
+			cut = cut[:i]
+			break
+		}
+	}
+	return strings.TrimRightFunc(string(cut), unicode.IsSpace) + "..."
+}
+
+// listFilterFlags narrow a metadata-only listing.
+var listFilterFlags = []string{"--tag", "--ext", "--under", "--path"}
+
+func hasListFilters(args []string) bool {
+	for _, f := range listFilterFlags {
+		if _, ok := flagValue(args, f); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// listFilters builds a cmd request carrying the listFilterFlags in args,
+// with --under and --path made absolute.
+func listFilters(cmd string, args []string) Message {
+	msg := Message{Cmd: cmd, Extensions: listFlag(args, "--ext")}
+	msg.Tag, _ = flagValue(args, "--tag")
+	for flag, dst := range map[string]*string{"--under": &msg.Under, "--path": &msg.Path} {
+		if v, ok := flagValue(args, flag); ok {
+			abs, err := filepath.Abs(v)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(1)
+			}
+			*dst = abs
+		}
+	}
+	return msg
+}
+
+// countChunks prints the number of chunks matching the filters in args and
+// nothing else, so it can be used in $(...).
+func countChunks(client *RecallClient, args []string) {
+	resp, err := client.call(listFilters("count", args))
+	if err == nil && resp.Status == "error" {
+		err = errors.New(resp.Error)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Println(resp.Count)
+}
+
+// listChunks prints the chunks matching the filters in args, one per line,
+// paged with --limit and --offset; --limit 0 lists every match.
+func listChunks(client *RecallClient, args []string, maxLimit int) {
+	msg := listFilters("list", args)
+	msg.Limit = limitFlag(args, 50, maxLimit, true)
+	msg.Offset = intFlag(args, "--offset", 0)
+	if msg.Offset < 0 {
+		fmt.Fprintln(os.Stderr, "Error: --offset can't be negative")
+		os.Exit(1)
+	}
+
+	resp, err := client.call(msg)
+	if err == nil && resp.Status == "error" {
+		err = errors.New(resp.Error)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	if len(resp.Results) == 0 {
+		fmt.Printf("No chunks found (%d match).\n", resp.Count)
+		return
+	}
+	fmt.Printf("Showing %d-%d of %d chunks\n", msg.Offset+1, msg.Offset+len(resp.Results), resp.Count)
+	for _, r := range resp.Results {
+		line := fmt.Sprintf("%s  chunk %d/%d", r.Path, r.ChunkIdx+1, r.FileChunks)
+		if r.Tags != "" {
+			line += "  [" + r.Tags + "]"
+		}
+		fmt.Println(line)
+	}
+}
+
+// keywordModes are how --keyword-mode matches query words in a hybrid
+// search: whole words, word starts, or anywhere.
+var keywordModes = []string{"exact", "prefix", "substring"}
+
+// sortKeys are the orders --sort accepts; score is the default.
+var sortKeys = []string{"score", "path", "mtime", "filename", "recency", "date"}
+
+// sortResults reorders results in place. Results already come by score, so
+// "score" leaves them alone; mtime is oldest first, so files read in the
+// order they were written.
+func sortResults(results []Result, by string) {
+	switch by {
+	case "path":
+		sort.SliceStable(results, func(i, j int) bool {
+			if results[i].Path != results[j].Path {
+				return results[i].Path < results[j].Path
+			}
+			return results[i].ChunkIdx < results[j].ChunkIdx
+		})
+	case "filename":
+		sort.SliceStable(results, func(i, j int) bool { return results[i].Filename < results[j].Filename })
+	case "mtime":
+		// Chunks indexed before mtime was recorded fall back to the file itself
+		for i := range results {
+			if results[i].Mtime == 0 {
+				if info, err := os.Stat(results[i].Path); err == nil {
+					results[i].Mtime = float64(info.ModTime().UnixNano()) / 1e9
+				}
+			}
+		}
+		sort.SliceStable(results, func(i, j int) bool { return results[i].Mtime < results[j].Mtime })
+	case "recency":
+		// Most recently indexed first; RFC 3339 UTC times sort as strings,
+		// and chunks from before indexed_at was recorded sort last
+		sort.SliceStable(results, func(i, j int) bool { return results[i].IndexedAt > results[j].IndexedAt })
+	case "date":
+		// The frontmatter date, oldest first like mtime; ISO dates sort as
+		// strings, and results without one go last
+		sort.SliceStable(results, func(i, j int) bool {
+			if (results[i].Date == "") != (results[j].Date == "") {
+				return results[j].Date == ""
+			}
+			return results[i].Date < results[j].Date
+		})
+	}
+}
+
+// printWarnings reports a response's warnings on stderr.
+func printWarnings(resp *Message) {
+	for _, w := range resp.Warnings {
+		logger.Warn(w)
+	}
+}
+
+// readOnlyBlocked are the commands --read-only disables.
+var readOnlyBlocked = map[string]bool{
+	"index": true, "clear": true, "remove": true, "restore": true, "empty-trash": true, "compact": true,
+	"copy-collection": true, "reindex": true,
+}
+
+// indexReaders only read an existing index, so they have nothing to do
+// without a database rather than creating an empty one.
+var indexReaders = map[string]bool{
+	"search": true, "query": true, "q": true, "refine": true, "stats": true, "list": true, "list-chunks": true,
+	"count": true, "verify": true, "json": true, "context": true,
+}
+
+// verifyAnomalies are the problems verify reports, in display order.
+var verifyAnomalies = []struct{ key, label string }{
+	{"missing_embedding", "Missing embedding:"},
+	{"wrong_dimension", "Wrong dimension:"},
+	{"missing_metadata", "Missing metadata:"},
+	{"empty_text", "Empty text:"},
+	{"missing_file", "File no longer exists:"},
+	{"incomplete_file", "Wrong chunk count:"},
+}
+
+// explainNoResults tells the user, on stderr, the likely reason a search
+// came back empty: total is the collection's chunk count, fetched what the
+// index returned, and scored what was left after --min-score.
+func explainNoResults(client *RecallClient, total, fetched, scored int, minScore float64, budget int) {
+	switch {
+	case total == 0:
+		fmt.Fprintln(os.Stderr, "The collection is empty; add files with: jb-recall index <path>")
+	case fetched > 0 && scored == 0:
+		fmt.Fprintf(os.Stderr, "%d results were found, but none scored %.2f or more (lower --min-score)\n", fetched, minScore)
+	case fetched > 0:
+		fmt.Fprintf(os.Stderr, "%d results were found, but the first doesn't fit in --budget %d\n", fetched, budget)
+	default:
+		// Search skips trashed chunks, which still count towards the total
+		resp, err := client.call(Message{Cmd: "stats"})
+		if err == nil && resp.Trashed >= total {
+			fmt.Fprintf(os.Stderr, "All %d chunks are in the trash (see jb-recall restore)\n", total)
+		} else {
+			fmt.Fprintf(os.Stderr, "The index returned no neighbors for this query among %d chunks\n", total)
+		}
+	}
+}
+
+// dedupeResults drops results whose text repeats an earlier, better-scoring
+// one, as happens when the same file is indexed under two paths.
+func dedupeResults(results []Result) []Result {
+	seen := make(map[string]bool)
+	var kept []Result
+	for _, r := range results {
+		key := strings.TrimSpace(r.Text)
+		if !seen[key] {
+			seen[key] = true
+			kept = append(kept, r)
+		}
+	}
+	return kept
+}
+
+// contextBlock joins results into one block for an LLM prompt, each chunk
+// preceded by a [source: path] citation, or by its [citation key] if set.
+func contextBlock(results []Result) string {
+	var b strings.Builder
+	for i, r := range results {
+		if i > 0 {
+			b.WriteString("\n")
+		}
+		source := "source: " + r.Path
+		if r.Cite != "" {
+			source = r.Cite
+		}
+		fmt.Fprintf(&b, "[%s]\n%s\n", source, strings.TrimSpace(r.Text))
+	}
+	return b.String()
+}
+
+// uniquePaths returns the distinct source paths of results, keeping the
+// order of each path's best-scoring chunk.
+func uniquePaths(results []Result) []string {
+	seen := make(map[string]bool)
+	var paths []string
+	for _, r := range results {
+		if !seen[r.Path] {
+			seen[r.Path] = true
+			paths = append(paths, r.Path)
+		}
+	}
+	return paths
+}
+
+// printOneline prints score<TAB>path<TAB>snippet per result, for fzf-style
+// pickers. Whitespace in the snippet is collapsed so each result is one line.
+func printOneline(results []Result, preview int) {
+	for _, r := range results {
+		text := r.Snippet
+		if text == "" && preview > 0 {
+			text = truncate(r.Text, preview)
+		} else if text == "" {
+			text = r.Text
+		}
+		if r.Cite != "" {
+			text = "[" + r.Cite + "] " + text
+		}
+		fmt.Printf("%.2f\t%s\t%s\n", r.Score, r.Path, strings.Join(strings.Fields(text), " "))
+	}
+}
+
+func formatSize(n int64) string {
+	switch {
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1f MB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1f KB", float64(n)/(1<<10))
+	}
+	return fmt.Sprintf("%d B", n)
+}
+
+func printQueryStats(resp *Message) {
+	ef := "default"
+	if resp.EfSearch > 0 {
+		ef = strconv.Itoa(resp.EfSearch)
+	}
+	logger.Info(fmt.Sprintf("Query took %.1f ms (ef_search=%s)", resp.QueryMs, ef), "query_ms", resp.QueryMs, "ef_search", ef)
+}
+
+// lastSearchPath holds the most recent search so refine can refer to its
+// results by number.
+func lastSearchPath(rootDir string) string {
+	return filepath.Join(rootDir, "last_search.json")
+}
+
+func saveLastSearch(rootDir, query string, results []Result) {
+	data, err := json.Marshal(Message{Query: query, Results: results})
+	if err != nil {
+		return
+	}
+	os.WriteFile(lastSearchPath(rootDir), data, 0644)
+}
+
+func loadLastSearch(rootDir string) (*Message, error) {
+	data, err := os.ReadFile(lastSearchPath(rootDir))
+	if err != nil {
+		return nil, err
+	}
+	var msg Message
+	err = json.Unmarshal(data, &msg)
+	return &msg, err
+}
+
+// HistoryEntry is one line of the query history.
+type HistoryEntry struct {
+	Time    time.Time `json:"time"`
+	Command string    `json:"command"`
+	Query   string    `json:"query"`
+	Results int       `json:"results"`
+}
+
+// historyPath is an append-only JSON-lines log of past queries.
+func historyPath(rootDir string) string {
+	return filepath.Join(rootDir, "history.jsonl")
+}
+
+func appendHistory(rootDir, command, query string, results int) {
+	data, err := json.Marshal(HistoryEntry{Time: time.Now(), Command: command, Query: query, Results: results})
+	if err != nil {
+		return
+	}
+	f, err := os.OpenFile(historyPath(rootDir), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	f.Write(append(data, '\n'))
+}
+
+// loadHistory returns up to the last n history entries, oldest first.
+// Unparseable lines (e.g. from a write cut short) are skipped.
+func loadHistory(rootDir string, n int) ([]HistoryEntry, error) {
+	data, err := os.ReadFile(historyPath(rootDir))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var entries []HistoryEntry
+	for _, line := range strings.Split(string(data), "\n") {
+		var e HistoryEntry
+		if line != "" && json.Unmarshal([]byte(line), &e) == nil {
+			entries = append(entries, e)
+		}
+	}
+	if n > 0 && len(entries) > n {
+		entries = entries[len(entries)-n:]
+	}
+	return entries, nil
+}
+
+// resultIDs maps the 1-based result numbers given to flag (e.g. "--like 2,3")
+// onto chunk IDs from results.
+func resultIDs(results []Result, args []string, flag string) ([]string, error) {
+	v, ok := flagValue(args, flag)
+	if !ok {
+		return nil, nil
+	}
+	var ids []string
+	for _, part := range strings.Split(v, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil || n < 1 || n > len(results) {
+			return nil, fmt.Errorf("%s %s: no result #%s in the last search", flag, v, part)
+		}
+		ids = append(ids, results[n-1].ID)
+	}
+	return ids, nil
+}
+
+func printUsage() {
+	fmt.Println(`jb-recall - Semantic memory layer
+
+Usage:
+  jb-recall index <path>...  Index files and/or directories
+  jb-recall search <query>   Search indexed content
+  jb-recall refine [query]   Re-run the last search with --like/--unlike feedback
+  jb-recall stats            Show database statistics
+  jb-recall history          List recent queries (--limit, default 20)
+  jb-recall saved [name]     Run a query saved with --save-query, or list them
+  jb-recall clear            Clear the database
+  jb-recall restore <path>   Restore trashed chunks for a file or directory
+  jb-recall empty-trash      Permanently remove trashed chunks
+  jb-recall list             List chunks by metadata only (--tag, --ext, --under, --path)
+                             (alias: list-chunks)
+  jb-recall count            Print the number of chunks matching --tag, --ext, --under, --path
+  jb-recall remove --tag <t> Delete every chunk with the given tag
+  jb-recall bench            Time indexing and search on a synthetic corpus (--docs, --queries)
+  jb-recall compact          Rebuild the database to reclaim space after heavy churn
+  jb-recall reindex          Re-embed every indexed file, e.g. after a model change (--resume continues
+                             an interrupted run)
+  jb-recall use [collection] Set the collection later commands default to, or show it (--clear resets)
+  jb-recall copy-collection <src> <dest>
+                             Snapshot a collection without re-embedding (--overwrite replaces dest)
+  jb-recall json <query>     Search and output JSON (for integration)
+  jb-recall context <query>  Print top chunks with [source: path] citations for an LLM prompt
+  jb-recall embed [text]     Embed text (or stdin, or with --stdin) and output the vector as JSON
+  jb-recall prefetch         Create the environment and cache the model, then exit (e.g. in a Docker build)
+  jb-recall serve            Run an HTTP server (--addr, default 127.0.0.1:7700)
+  jb-recall rpc              Answer JSON-RPC 2.0 requests on stdin/stdout, one per line
+  jb-recall mcp              Run an MCP server on stdin/stdout with search and index tools
+  jb-recall verify           Check chunks for bad embeddings, metadata, text or chunk counts, or missing files (--fix removes them)
+  jb-recall daemon           Run the background helper used by --daemon in the foreground
+
+Options:
+  --force                       Re-index files even if unchanged
+  --dry-run                     index: report file and chunk estimates only
+  --yes                         index: skip the confirmation for large runs
+  --follow-symlinks             index: descend into symlinked directories
+  --only-new                    index: only add files not indexed yet, without checking others for changes
+  --reuse-embeddings            index: re-embed only chunks whose text changed, reusing the rest
+  --max-concurrent-files <n>    index: read and chunk up to n files ahead while embedding (default 1)
+  --encoding <codec>            index: decode text files with this codec instead of UTF-8, e.g. latin-1
+  --frontmatter                 index: store markdown frontmatter as metadata (title, date, tags) instead of text
+  --frontmatter-title           index: like --frontmatter, and also index the title as the start of the text
+  --max-depth <n>               index: walk at most n levels below each directory (0: its own files only)
+  --chunk-strategy <map>        index: per-extension chunking, e.g. md=markdown,py=code
+  --tag <tag>[,<tag>...]        index: label the indexed chunks (repeatable)
+  --fail-on-empty               index: exit non-zero if no file was (re)indexed
+  --chunk-ids <index|content>   index: number chunk IDs (path::0, default) or derive them from chunk text
+  --mail                        index: also index .eml and .mbox files in directories
+  --archives                    index: read text files inside .zip, .tar and .tar.gz archives, stored as archive.zip!entry
+  --name <logical-name>         index: store a single file under this name instead of its path
+  --stdin-jsonl                 index: read pre-chunked {"text","path","meta"} lines from stdin and embed them as-is
+  --strip-pattern <regex>       index: delete matching text before chunking (repeatable)
+  --strip-code-fences           index: replace fenced code blocks with a [code block] placeholder before chunking
+  --collection <name>           Use a named collection instead of the default
+  --auto-collection             Use a collection per git repository (from the working directory)
+  --daemon                      Run through a warm background helper, starting it if needed
+  --daemon-idle <seconds>       daemon: exit after this long without clients (default 300)
+  --idle-timeout <duration>     serve: exit after this long without requests, e.g. 30m (default 0, never)
+  --watch                       daemon: keep the config's "watch" directories indexed, and don't exit when idle
+  --root <dir>                  Keep the environment, database and state here (default ~/.jb-recall)
+  --config <file>               Read config from this file instead of <root>/config.json
+  --read-only                   Refuse index, reindex, clear, remove, restore, empty-trash, compact, copy-collection
+                                and verify --fix
+  --script <path>               Run this recall.py instead of the embedded one (or JB_RECALL_SCRIPT)
+  --log-format <text|json>      Diagnostics on stderr as plain lines (default) or JSON objects
+  --max-results-text-bytes <n>  Cap on result text per search response (default 1 MiB; 0: no cap)
+  --quiet                       Only warnings and errors on stderr (no "Database ready" line)
+  --json                        stats: print the counts as JSON
+  --verbose                     Show extra diagnostics (e.g. query timing)
+  --channel <name|url>          Conda channel for the first-run setup (default conda-forge)
+  --embedding-backend <name>    sentence-transformers (default) or fastembed (no torch)
+  --threads <n>                 Limit CPU threads used for embedding
+  --query-prefix <text>         Prepend to queries before embedding (e.g. "query: " for E5)
+  --passage-prefix <text>       Prepend to indexed text before embedding (e.g. "passage: ")
+  --framing <newline|length>    Wire framing between Go and Python (default newline)
+  --no-install                  Never pip install; use a pre-provisioned environment (or JB_RECALL_NO_INSTALL=1)
+  --ef-search <n>               HNSW query-time candidate list size (set by index runs)
+  --by-id <chunk-id>            search: find chunks similar to a stored chunk
+  --files-only                  search: print only matching file paths
+  --snippet                     search: show the sentences that best match the query
+  --oneline                     search: print score<TAB>path<TAB>snippet per result
+  --merge-adjacent              search: merge neighbouring chunks of a file into one result, without repeating their overlap
+  --limit <n>                   search, context, list, history: maximum number of entries
+                                (capped at max_limit, default 1000; list --limit 0 lists all)
+  --min-score <score>           search: drop results scoring below this (0-1)
+  --save-query <name>           search: save the query and its flags for jb-recall saved
+  --offset <n>                  list: skip this many matching chunks
+  --tag <tag>                   list, search without a query: only chunks with this tag
+  --ext <ext>[,<ext>...]        list, search without a query: only these file extensions
+  --under <dir>                 list, search without a query: only files under dir
+  --path <file>                 list, search without a query: only chunks of this file
+  --compact                     json: print on one line, without indentation
+  --fields <f>[,<f>...]         json: include only these result fields, e.g. id,score,path
+  --no-text                     json: leave out chunk text; results have only id, score, path, filename, chunk_idx
+  --as-query                    embed: add the query prefix, as a search would
+  --preview-chars <n>           search, refine: characters of each result to show (default 300)
+  --no-truncate                 search, refine: show each result's full text
+  --cite                        search, refine, json, context: label results with keys like notes/foo.md#c3
+  --show-time                   search, refine: show when each result was indexed (also with --verbose)
+  --relative                    search: show paths relative to the indexed directory
+  --relative-to <dir>           search: show paths relative to dir
+  --relative-to-cwd             search: show paths relative to the working directory
+  --sort <key>                  search: order by score (default), path, mtime, filename, recency or date (frontmatter)
+  --recency-boost               search: decay scores by age, so newer chunks rank higher
+  --half-life <days>            search: --recency-boost halves a score every n days (default 30)
+  --score-weights <k=w>[,...]   search: rank by weighted signals: vector, recency, tag:<name>, path:<dir>
+  --keyword-mode <mode>         search: hybrid vector and keyword ranking, matching words exact, prefix or substring
+  --budget <chars>              search, context: return as many results as fit in this much text
+  --like <n>[,<n>...]           refine: results to move toward
+  --unlike <n>[,<n>...]         refine: results to move away from
+  --hnsw-ef-construction <n>    HNSW build-time candidate list size (new db only)
+  --hnsw-m <n>                  HNSW links per node (new db only)
+
+Examples:
+  jb-recall index ~/clawd/memory
   jb-recall search "what did we discuss about FDA wrappers"
-  jb-recall q moltbot migration`)
+  jb-recall q moltbot migration
+  echo "some text" | jb-recall embed`)
+}
+
+// valueFlags lists the --flags that take the following argument as their value.
+var valueFlags = map[string]bool{
+	"--addr":                   true,
+	"--idle-timeout":           true,
+	"--budget":                 true,
+	"--by-id":                  true,
+	"--channel":                true,
+	"--chunk-strategy":         true,
+	"--collection":             true,
+	"--daemon-idle":            true,
+	"--log-format":             true,
+	"--max-results-text-bytes": true,
+	"--max-depth":              true,
+	"--script":                 true,
+	"--chunk-ids":              true,
+	"--preview-chars":          true,
+	"--fields":                 true,
+	"--relative-to":            true,
+	"--strip-pattern":          true,
+	"--config":                 true,
+	"--root":                   true,
+	"--docs":                   true,
+	"--embedding-backend":      true,
+	"--encoding":               true,
+	"--ext":                    true,
+	"--framing":                true,
+	"--tag":                    true,
+	"--threads":                true,
+	"--under":                  true,
+	"--ef-search":              true,
+	"--like":                   true,
+	"--min-score":              true,
+	"--half-life":              true,
+	"--max-concurrent-files":   true,
+	"--score-weights":          true,
+	"--keyword-mode":           true,
+	"--limit":                  true,
+	"--name":                   true,
+	"--offset":                 true,
+	"--passage-prefix":         true,
+	"--path":                   true,
+	"--queries":                true,
+	"--query-prefix":           true,
+	"--save-query":             true,
+	"--sort":                   true,
+	"--unlike":                 true,
+	"--hnsw-ef-construction":   true,
+	"--hnsw-m":                 true,
+}
+
+// positional returns the arguments that are not --flags or flag values.
+func positional(args []string) []string {
+	var out []string
+	for i := 0; i < len(args); i++ {
+		if strings.HasPrefix(args[i], "--") {
+			if valueFlags[args[i]] {
+				i++
+			}
+			continue
+		}
+		out = append(out, args[i])
+	}
+	return out
+}
+
+// flagValue returns the argument following name, if name is present.
+func flagValue(args []string, name string) (string, bool) {
+	for i, a := range args {
+		if a == name && i+1 < len(args) {
+			return args[i+1], true
+		}
+	}
+	return "", false
+}
+
+// floatFlag parses a numeric flag, exiting with an error if it is malformed.
+func floatFlag(args []string, name string, def float64) float64 {
+	v, ok := flagValue(args, name)
+	if !ok {
+		return def
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s expects a number, got %q\n", name, v)
+		os.Exit(1)
+	}
+	return f
+}
+
+// listFlag collects every value of a repeatable flag, splitting each on
+// commas, so "--tag a,b --tag c" yields [a b c].
+func listFlag(args []string, name string) []string {
+	var values []string
+	for i, a := range args {
+		if a == name && i+1 < len(args) {
+			for _, v := range strings.Split(args[i+1], ",") {
+				if v = strings.TrimSpace(v); v != "" {
+					values = append(values, v)
+				}
+			}
+		}
+	}
+	return values
+}
+
+// intFlag parses an integer flag, exiting with an error if it is malformed.
+func intFlag(args []string, name string, def int) int {
+	v, ok := flagValue(args, name)
+	if !ok {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s expects a number, got %q\n", name, v)
+		os.Exit(1)
+	}
+	return n
 }
 
 func contains(slice []string, item string) bool {
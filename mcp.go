@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+)
+
+// jb-recall mcp is a Model Context Protocol server on stdin/stdout: the
+// search and index commands as tools, and the database's stats as a
+// resource. MCP is JSON-RPC 2.0, so it runs over runRPC.
+
+// mcpProtocolVersions are the MCP revisions this server speaks, newest first.
+var mcpProtocolVersions = []string{"2025-06-18", "2025-03-26", "2024-11-05"}
+
+const mcpDatabaseURI = "recall://database"
+
+type mcpTool struct {
+	Name        string         `json:"name"`
+	Description string         `json:"description"`
+	InputSchema map[string]any `json:"inputSchema"`
+}
+
+type mcpContent struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+type mcpToolResult struct {
+	Content []mcpContent `json:"content"`
+	IsError bool         `json:"isError,omitempty"`
+}
+
+var mcpSearchTool = mcpTool{
+	Name:        "search",
+	Description: "Semantic search over the indexed files. Returns the best-matching chunks, each labelled with its source path.",
+	InputSchema: map[string]any{
+		"type": "object",
+		"properties": map[string]any{
+			"query":     map[string]any{"type": "string", "description": "What to search for, in natural language"},
+			"limit":     map[string]any{"type": "integer", "minimum": 1, "description": "Number of results (default 5)"},
+			"min_score": map[string]any{"type": "number", "description": "Drop results scoring below this"},
+		},
+		"required": []string{"query"},
+	},
+}
+
+var mcpIndexTool = mcpTool{
+	Name:        "index",
+	Description: "Index a file, or a directory recursively, so it can be searched. Unchanged files are skipped.",
+	InputSchema: map[string]any{
+		"type": "object",
+		"properties": map[string]any{
+			"path":  map[string]any{"type": "string", "description": "File or directory to index"},
+			"force": map[string]any{"type": "boolean", "description": "Re-index files even if unchanged"},
+		},
+		"required": []string{"path"},
+	},
+}
+
+// mcpMethods answers the MCP requests jb-recall supports. With --read-only
+// the index tool isn't offered.
+func mcpMethods(client *RecallClient, maxLimit int) rpcHandler {
+	tools := []mcpTool{mcpSearchTool}
+	if !client.opts.ReadOnly {
+		tools = append(tools, mcpIndexTool)
+	}
+
+	return func(method string, params json.RawMessage) (any, error) {
+		switch method {
+		case "initialize":
+			var p struct {
+				ProtocolVersion string `json:"protocolVersion"`
+			}
+			if err := decodeParams(params, &p); err != nil {
+				return nil, err
+			}
+			// Agree to the client's revision if we know it, else offer ours
+			version := mcpProtocolVersions[0]
+			if slices.Contains(mcpProtocolVersions, p.ProtocolVersion) {
+				version = p.ProtocolVersion
+			}
+			return map[string]any{
+				"protocolVersion": version,
+				"capabilities":    map[string]any{"tools": map[string]any{}, "resources": map[string]any{}},
+				"serverInfo":      map[string]any{"name": "jb-recall", "version": "1"},
+			}, nil
+
+		case "ping":
+			return map[string]any{}, nil
+
+		case "tools/list":
+			return map[string]any{"tools": tools}, nil
+
+		case "tools/call":
+			var p struct {
+				Name      string          `json:"name"`
+				Arguments json.RawMessage `json:"arguments"`
+			}
+			if err := decodeParams(params, &p); err != nil {
+				return nil, err
+			}
+			if !slices.ContainsFunc(tools, func(t mcpTool) bool { return t.Name == p.Name }) {
+				return nil, &rpcError{rpcInvalidParams, fmt.Sprintf("unknown tool: %s", p.Name)}
+			}
+			return mcpCallTool(client, p.Name, p.Arguments, maxLimit), nil
+
+		case "resources/list":
+			return map[string]any{"resources": []map[string]any{{
+				"uri":         mcpDatabaseURI,
+				"name":        "database",
+				"description": "Chunk counts for the jb-recall index",
+				"mimeType":    "application/json",
+			}}}, nil
+
+		case "resources/read":
+			var p struct {
+				URI string `json:"uri"`
+			}
+			if err := decodeParams(params, &p); err != nil {
+				return nil, err
+			}
+			if p.URI != mcpDatabaseURI {
+				return nil, &rpcError{rpcInvalidParams, fmt.Sprintf("unknown resource: %s", p.URI)}
+			}
+			resp, err := rpcCall(client, Message{Cmd: "stats"})
+			if err != nil {
+				return nil, err
+			}
+			data, _ := json.Marshal(Message{Count: resp.Count, Trashed: resp.Trashed, Collection: client.opts.Collection})
+			return map[string]any{"contents": []map[string]any{{
+				"uri":      mcpDatabaseURI,
+				"mimeType": "application/json",
+				"text":     string(data),
+			}}}, nil
+		}
+		return nil, &rpcError{rpcMethodNotFound, fmt.Sprintf("method not found: %s", method)}
+	}
+}
+
+// mcpCallTool runs a tool. Its failures, bad arguments included, go back
+// to the model as an error result rather than a protocol error, so it can
+// correct itself.
+func mcpCallTool(client *RecallClient, name string, args json.RawMessage, maxLimit int) mcpToolResult {
+	var text string
+	var err error
+	switch name {
+	case "search":
+		var p rpcSearchParams
+		var resp *Message
+		if err = decodeParams(args, &p); err == nil {
+			// Text output has no use for a field list
+			p.Fields = nil
+			resp, err = rpcSearch(client, p, maxLimit)
+		}
+		if err == nil {
+			text = contextBlock(resp.Results)
+			if text == "" {
+				text = "No results found."
+			}
+		}
+
+	case "index":
+		var p rpcIndexParams
+		var resp *Message
+		if err = decodeParams(args, &p); err == nil {
+			resp, err = rpcIndex(client, p)
+		}
+		switch {
+		case err != nil:
+		case resp.Status == "indexed":
+			text = fmt.Sprintf("Indexed %s (%d chunks)", resp.Path, resp.Chunks)
+		case resp.Status == "skipped":
+			text = fmt.Sprintf("Skipped %s (%s)", p.Path, resp.Reason)
+		default:
+			text = fmt.Sprintf("Indexed %d files (%d skipped, %d chunks)", resp.Indexed, resp.Skipped, resp.Chunks)
+		}
+	}
+	if err != nil {
+		return mcpToolResult{Content: []mcpContent{{Type: "text", Text: err.Error()}}, IsError: true}
+	}
+	return mcpToolResult{Content: []mcpContent{{Type: "text", Text: text}}}
+}
@@ -6,36 +6,363 @@ Uses ChromaDB for vector storage and sentence-transformers for embeddings.
 import jumpboot
 import json
 import os
+import random
 import hashlib
-from pathlib import Path
+import bisect
+import codecs
+import encodings.aliases
+import email
+import email.policy
+import mailbox
+import math
+import re
+import secrets
+import signal
+import struct
+import tarfile
+import tempfile
+import time
+import types
+import zipfile
+from collections import deque
+from concurrent.futures import ThreadPoolExecutor
+from datetime import datetime, timezone
+from pathlib import Path, PurePosixPath
 
 # Lazy load heavy imports
 _chroma_client = None
 _collection = None
+_db_path = None
 _embedder = None
+_model_revision = None
 
-def get_embedder():
+# Instruction-tuned models (E5, BGE, ...) expect inputs marked as a query or
+# a passage; set at init from --query-prefix/--passage-prefix
+_query_prefix = ''
+_passage_prefix = ''
+
+# Set at init from --read-only; see WRITE_ACTIONS
+_read_only = False
+
+# Query-time ef from --ef-search, stored on the collection by the index
+# commands (see apply_ef_search); 0 leaves it as it is
+_ef_search = 0
+
+# Bytes of result text one search response may carry, from
+# --max-results-text-bytes; None for no cap. See cap_text.
+_max_text_bytes = None
+
+MODEL_NAME = 'all-MiniLM-L6-v2'
+DEFAULT_BACKEND = 'sentence-transformers'
+DEFAULT_COLLECTION = 'memory'
+
+# Set by SIGINT/SIGTERM; long-running commands stop at the next file boundary
+_shutdown_requested = False
+
+def request_shutdown(signum, frame):
+    global _shutdown_requested
+    _shutdown_requested = True
+
+class FastEmbedder:
+    """Gives fastembed's ONNX model the encode() interface used throughout."""
+    
+    def __init__(self, model_name, threads=None):
+        from fastembed import TextEmbedding
+        self.model = TextEmbedding(model_name=f"sentence-transformers/{model_name}", threads=threads)
+    
+    def encode(self, texts):
+        import numpy as np
+        return np.array(list(self.model.embed(list(texts))))
+
+# Modules each backend imports; checked up front when installs are disabled
+BACKEND_MODULES = {
+    'sentence-transformers': ['chromadb', 'torch', 'sentence_transformers'],
+    'fastembed': ['chromadb', 'fastembed'],
+}
+
+def missing_modules(backend=DEFAULT_BACKEND):
+    """Return the backend's modules that can't be found in this environment."""
+    from importlib.util import find_spec
+    return [name for name in BACKEND_MODULES.get(backend, []) if find_spec(name) is None]
+
+def get_embedder(backend=DEFAULT_BACKEND):
     global _embedder
     if _embedder is None:
-        from sentence_transformers import SentenceTransformer
-        _embedder = SentenceTransformer('all-MiniLM-L6-v2')
+        # --threads arrives as OMP_NUM_THREADS; apply it explicitly as well,
+        # since not every runtime sizes its pool from the environment
+        threads = int(os.environ.get('OMP_NUM_THREADS', 0))
+        if backend == 'fastembed':
+            _embedder = FastEmbedder(MODEL_NAME, threads or None)
+        else:
+            import torch
+            if threads:
+                torch.set_num_threads(threads)
+            from sentence_transformers import SentenceTransformer
+            _embedder = SentenceTransformer(MODEL_NAME)
     return _embedder
 
-def get_collection(db_path):
-    global _chroma_client, _collection
+def model_revision(backend=DEFAULT_BACKEND):
+    """Identify the loaded model: library version plus the cached snapshot.
+    
+    Recorded on every chunk so embeddings from an upgraded library or an
+    updated upstream model can be told apart from the current ones.
+    """
+    from importlib.metadata import version, PackageNotFoundError
+    try:
+        revision = f"{backend} {version(backend)}"
+    except PackageNotFoundError:
+        revision = backend
+    if backend == DEFAULT_BACKEND:
+        # The hub cache stores each model download under snapshots/<commit>
+        try:
+            from huggingface_hub import try_to_load_from_cache
+            cached = try_to_load_from_cache(f"sentence-transformers/{MODEL_NAME}", "config.json")
+            if isinstance(cached, str):
+                revision += f" {Path(cached).parent.name}"
+        except Exception:
+            pass
+    return revision
+
+def revision_mismatch(collection, revision):
+    """Warn when some chunks were embedded by a different model revision."""
+    stale = collection.get(where={"model_revision": {"$ne": revision}}, limit=1, include=["metadatas"])
+    # Chunks indexed before revisions were recorded carry no key; stay quiet
+    stored = stale['metadatas'][0].get('model_revision') if stale['ids'] else None
+    if not stored:
+        return []
+    return [
+        f"some chunks were embedded by {stored} but "
+        f"{revision} is loaded; embeddings may be mixed, re-index with --force"
+    ]
+
+# Chroma's defaults, used when an existing collection doesn't record a value
+HNSW_DEFAULTS = {"hnsw:construction_ef": 100, "hnsw:M": 16, "hnsw:search_ef": 10}
+
+def get_collection(db_path, hnsw=None, backend=DEFAULT_BACKEND, name=DEFAULT_COLLECTION, prefixes=None):
+    global _chroma_client, _collection, _db_path
+    # A warm process (see jb-recall daemon) is re-initialized by every
+    # client, which may want another database or collection
+    if _collection is not None and (_db_path != db_path or _collection.name != name):
+        close_collection()
     if _collection is None:
+        _db_path = db_path
         import chromadb
         from chromadb.config import Settings
         _chroma_client = chromadb.PersistentClient(
             path=db_path,
             settings=Settings(anonymized_telemetry=False)
         )
-        _collection = _chroma_client.get_or_create_collection(
-            name="memory",
-            metadata={"hnsw:space": "cosine"}
-        )
+        metadata = {"hnsw:space": "cosine", "embedding_backend": backend}
+        metadata.update(hnsw or {})
+        # Chroma rejects empty metadata values; a missing prefix means none
+        metadata.update({k: v for k, v in (prefixes or {}).items() if v})
+        # HNSW parameters are fixed at creation, so only pass them for a new
+        # collection rather than letting get_or_create try to alter them
+        try:
+            _collection = _chroma_client.get_collection(name=name)
+        except Exception:
+            _collection = recover_compacted(name)
+        if _collection is None:
+            _collection = _chroma_client.create_collection(
+                name=name,
+                metadata=metadata
+            )
     return _collection
 
+def backend_mismatch(collection, backend):
+    """Warn when the collection was built with a different embedding backend."""
+    # Collections from before the backend was recorded used sentence-transformers
+    stored = (collection.metadata or {}).get("embedding_backend", DEFAULT_BACKEND)
+    if stored == backend:
+        return []
+    return [
+        f"collection was indexed with the {stored} backend but {backend} is loaded; "
+        "vectors may differ slightly, re-index with --force for consistent results"
+    ]
+
+def prefix_mismatches(collection):
+    """Warn when the loaded prefixes differ from those the collection was
+    built with, since the stored and query vectors then aren't comparable."""
+    current = collection.metadata or {}
+    warnings = []
+    for key, loaded in (("query_prefix", _query_prefix), ("passage_prefix", _passage_prefix)):
+        stored = current.get(key, '')
+        if stored != loaded:
+            warnings.append(
+                f"collection was built with {key} {stored!r} but {loaded!r} is in use; "
+                "results may be degraded; use the original prefixes or index into a new --collection"
+            )
+    return warnings
+
+def hnsw_mismatches(collection, hnsw, db_path):
+    """Warn about requested HNSW parameters an existing collection can't honor."""
+    warnings = []
+    current = collection.metadata or {}
+    for key, wanted in (hnsw or {}).items():
+        actual = current.get(key, HNSW_DEFAULTS.get(key))
+        if actual != wanted:
+            warnings.append(
+                f"collection was created with {key}={actual}; {wanted} only applies "
+                f"to a new database (remove {db_path} and re-index to change it)"
+            )
+    return warnings
+
+def close_collection():
+    """Drop the Chroma client so nothing is left mid-write on exit.
+
+    Chroma commits each add/delete itself, so finishing the in-flight
+    operation before releasing the client is all a clean shutdown needs.
+    """
+    global _chroma_client, _collection
+    _collection = None
+    _chroma_client = None
+
+def dir_size(path):
+    """Total size in bytes of the files under path."""
+    total = 0
+    for root, _, filenames in os.walk(path):
+        for name in filenames:
+            try:
+                total += os.path.getsize(os.path.join(root, name))
+            except OSError:
+                pass
+    return total
+
+def copied_metadata(collection):
+    """Metadata for a copy of collection, including the ef_search an index
+    run may have set in its configuration since it was created."""
+    return {**(collection.metadata or {}), "hnsw:search_ef": configured_ef_search(collection)}
+
+def compact_prefix(name):
+    """The start of the temporary collection names compact copies name into.
+    
+    A hash of the whole name keeps collections whose names share the part
+    kept from telling each other's copies apart, and the result, with the
+    random suffix compact adds, stays within Chroma's 63 character limit.
+    """
+    return f"{name[:36]}-compact-{hashlib.sha1(name.encode('utf-8')).hexdigest()[:8]}-"
+
+def compact_leftovers(name):
+    """Names of the temporary copies of name that compact left behind."""
+    prefix = compact_prefix(name)
+    names = [c if isinstance(c, str) else c.name for c in _chroma_client.list_collections()]
+    return [n for n in names if n.startswith(prefix) and len(n) == len(prefix) + 8]
+
+def recover_compacted(name):
+    """Finish a compact that was interrupted between dropping the original
+    collection and renaming its copy: the copy, complete by then, takes the
+    original's name. Returns it, or None if there is nothing to recover."""
+    copies = [_chroma_client.get_collection(name=n) for n in compact_leftovers(name)]
+    if not copies:
+        return None
+    copy = max(copies, key=lambda c: c.count())
+    copy.modify(name=name)
+    return _chroma_client.get_collection(name=name)
+
+def compact(db_path, batch_size=1000):
+    """Rebuild the collection to shed space left behind by index/delete churn.
+    
+    Chroma has no compaction call, so every record is copied into a fresh
+    collection which then replaces the old one, and SQLite is vacuumed to
+    return freed pages to the filesystem. The old collection is only dropped
+    once the copy is complete; if the rename after that is interrupted,
+    get_collection finishes it. Returns the on-disk size before and after.
+    """
+    global _collection
+    before = dir_size(db_path)
+    name = _collection.name
+    # With the original still here, a leftover copy is one a previous run
+    # didn't finish filling
+    for leftover in compact_leftovers(name):
+        _chroma_client.delete_collection(leftover)
+    temp_name = compact_prefix(name) + secrets.token_hex(4)
+    fresh = _chroma_client.create_collection(name=temp_name, metadata=copied_metadata(_collection))
+    offset = 0
+    while True:
+        page = _collection.get(
+            limit=batch_size, offset=offset, include=["embeddings", "documents", "metadatas"]
+        )
+        if not page['ids']:
+            break
+        retry_locked(fresh.add,
+            ids=page['ids'],
+            embeddings=page['embeddings'],
+            documents=page['documents'],
+            metadatas=page['metadatas']
+        )
+        offset += len(page['ids'])
+    _chroma_client.delete_collection(name)
+    fresh.modify(name=name)
+    _collection = fresh
+    try:
+        import sqlite3
+        conn = sqlite3.connect(os.path.join(db_path, 'chroma.sqlite3'))
+        conn.execute('VACUUM')
+        conn.close()
+    except Exception:
+        pass
+    return before, dir_size(db_path)
+
+def copy_collection(source, dest, overwrite=False, batch_size=1000):
+    """Copy every chunk of the source collection, embeddings and metadata
+    included, into a new dest collection, without re-embedding anything.
+    
+    dest must not exist unless overwrite, and can't be the open collection
+    or source itself. Returns the number of chunks copied.
+    """
+    if source == dest:
+        raise ValueError("source and destination are the same collection")
+    src = _chroma_client.get_collection(name=source)
+    existing = [c if isinstance(c, str) else c.name for c in _chroma_client.list_collections()]
+    if dest in existing:
+        if not overwrite:
+            raise ValueError(f"collection {dest} already exists (use --overwrite to replace it)")
+        if _collection is not None and _collection.name == dest:
+            raise ValueError(f"collection {dest} is open; run with another --collection to replace it")
+        _chroma_client.delete_collection(dest)
+    # The metadata carries the HNSW settings, backend and prefixes, so the
+    # copy searches the way the original does
+    copy = _chroma_client.create_collection(name=dest, metadata=copied_metadata(src))
+    copied = 0
+    while True:
+        page = src.get(limit=batch_size, offset=copied, include=["embeddings", "documents", "metadatas"])
+        if not page['ids']:
+            break
+        retry_locked(copy.add,
+            ids=page['ids'],
+            embeddings=page['embeddings'],
+            documents=page['documents'],
+            metadatas=page['metadatas']
+        )
+        copied += len(page['ids'])
+    return copied
+
+class DatabaseLocked(Exception):
+    pass
+
+# Chroma's SQLite store reports "database is locked" when another process
+# holds the write lock, e.g. a search while an index run commits. It clears
+# within moments, so writes are retried before giving up.
+LOCK_RETRIES = 5
+LOCK_BACKOFF = 0.1  # seconds, doubled after each attempt
+
+def retry_locked(write, *args, **kwargs):
+    """Call a collection write, retrying while the database is locked.
+    
+    Raises DatabaseLocked once the retries are used up.
+    """
+    delay = LOCK_BACKOFF
+    for attempt in range(LOCK_RETRIES):
+        try:
+            return write(*args, **kwargs)
+        except Exception as e:
+            if 'database is locked' not in str(e):
+                raise
+            if attempt == LOCK_RETRIES - 1:
+                raise DatabaseLocked(f"database is locked; gave up after {LOCK_RETRIES} attempts") from e
+            time.sleep(delay)
+            delay *= 2
+
 def file_hash(path):
     """Quick hash to detect file changes."""
     with open(path, 'rb') as f:
@@ -53,168 +380,1891 @@ def chunk_text(text, chunk_size=500, overlap=50):
         start = end - overlap
     return chunks
 
-def index_file(collection, embedder, file_path, force=False):
-    """Index a single file, skipping if unchanged."""
-    path = Path(file_path)
+def pack_sections(sections, chunk_size=500, overlap=50):
+    """Merge consecutive sections into chunks of up to chunk_size.
+    
+    Sections longer than chunk_size fall back to fixed-size chunking.
+    """
+    chunks = []
+    current = ''
+    for section in sections:
+        if len(section) > chunk_size:
+            if current.strip():
+                chunks.append(current)
+            current = ''
+            chunks.extend(chunk_text(section, chunk_size, overlap))
+        elif len(current) + len(section) > chunk_size:
+            if current.strip():
+                chunks.append(current)
+            current = section
+        else:
+            current += section
+    if current.strip():
+        chunks.append(current)
+    return chunks
+
+def chunk_markdown(text, chunk_size=500, overlap=50):
+    """Split at headings so each chunk holds whole sections where possible."""
+    return pack_sections(re.split(r'(?m)^(?=#{1,6}\s)', text), chunk_size, overlap)
+
+def chunk_code(text, chunk_size=500, overlap=50):
+    """Split at unindented lines after a blank line, i.e. top-level definitions."""
+    return pack_sections(re.split(r'(?<=\n\n)(?=\S)', text), chunk_size, overlap)
+
+CHUNKERS = {"fixed": chunk_text, "markdown": chunk_markdown, "code": chunk_code}
+
+def chunker_for(path, strategies=None):
+    """Pick the chunk strategy for a file from an extension -> strategy map.
+    
+    Extensions without an entry use the map's "default", or fixed-size chunks.
+    """
+    strategies = strategies or {}
+    ext = path.suffix.lower().lstrip('.')
+    name = strategies.get(ext, strategies.get('default', 'fixed'))
+    if name not in CHUNKERS:
+        raise ValueError(f"unknown chunk strategy: {name}")
+    return name
+
+def compile_preprocessors(specs):
+    """Compile the config's {name, pattern, replace} regex replacements.
+    An invalid pattern raises, failing the whole index command up front."""
+    compiled = []
+    for spec in specs or []:
+        try:
+            compiled.append((spec['name'], re.compile(spec['pattern']), spec.get('replace', '')))
+        except re.error as e:
+            raise ValueError(f"preprocessor {spec['name']}: invalid pattern: {e}")
+    return compiled
+
+FRONTMATTER_EXTENSIONS = ('.md', '.markdown')
+
+# How index treats frontmatter: "fields" stores it as metadata, "title"
+# also puts the title at the top of the text so it's searchable
+FRONTMATTER_MODES = ('fields', 'title')
+
+def unquote(value):
+    value = value.strip()
+    if len(value) >= 2 and value[0] == value[-1] and value[0] in '"\'':
+        return value[1:-1]
+    return value
+
+def split_frontmatter(text):
+    """Split a leading YAML frontmatter block off markdown text.
+    
+    Returns the fields and the text after the block. Only what notes
+    commonly use is understood: "key: value" scalars, [a, b] lists and
+    "- item" lists; nested maps are skipped. Text without a closed block
+    comes back whole, with no fields.
+    """
+    m = re.match(r'---[ \t]*\r?\n(.*?)\r?\n---[ \t]*(?:\r?\n|$)', text, re.S)
+    if not m:
+        return {}, text
+    fields = {}
+    key = None
+    for line in m.group(1).splitlines():
+        if not line.strip() or line.lstrip().startswith('#'):
+            continue
+        item = re.match(r'\s*-\s+(.*)', line)
+        if item and key is not None:
+            if not isinstance(fields.get(key), list):
+                fields[key] = []
+            fields[key].append(unquote(item.group(1)))
+            continue
+        pair = re.match(r'([A-Za-z0-9_-]+)\s*:\s*(.*)', line)
+        if not pair:
+            key = None
+            continue
+        key, value = pair.group(1), pair.group(2).strip()
+        if value.startswith('[') and value.endswith(']'):
+            fields[key] = [unquote(v) for v in value[1:-1].split(',') if v.strip()]
+        else:
+            fields[key] = unquote(value)
+    return fields, text[m.end():]
+
+def frontmatter_value(value):
+    return ','.join(value) if isinstance(value, list) else value
+
+def frontmatter_tags(fields):
+    """The tags a frontmatter block lists, as a list or a comma- or
+    space-separated string, without any leading #."""
+    tags = fields.get('tags', [])
+    if isinstance(tags, str):
+        tags = re.split(r'[,\s]+', tags)
+    return [t.strip().lstrip('#') for t in tags if t.strip().lstrip('#')]
+
+def frontmatter_mode(mode):
+    if mode and mode not in FRONTMATTER_MODES:
+        raise ValueError(f"unknown frontmatter mode {mode!r} (want {' or '.join(FRONTMATTER_MODES)})")
+    return mode or ''
+
+def text_encoding(name):
+    """The codec plain-text files are decoded with: UTF-8 unless another is
+    named. An unknown name raises, failing the whole index command up front."""
+    if not name:
+        return 'utf-8'
+    try:
+        return codecs.lookup(name).name
+    except LookupError:
+        known = ', '.join(sorted(set(encodings.aliases.aliases.values())))
+        raise ValueError(f"unknown encoding {name!r}; supported codecs: {known}")
+
+def preprocessors_signature(preprocessors):
+    """Fingerprint of the configured replacements, so changing them
+    re-indexes files whose contents didn't change."""
+    if not preprocessors:
+        return ''
+    spec = [[name, regex.pattern, replace] for name, regex, replace in preprocessors]
+    return hashlib.md5(json.dumps(spec).encode('utf-8')).hexdigest()
+
+def preprocess(text, preprocessors):
+    """Apply each replacement in order; returns the new text and the names of
+    the preprocessors that changed something, which are recorded per chunk."""
+    applied = []
+    for name, regex, replace in preprocessors or []:
+        text, n = regex.subn(replace, text)
+        if n:
+            applied.append(name)
+    return text, applied
+
+# Separates notebook cells in the text that gets chunked
+CELL_SEPARATOR = '\n\n'
+
+def notebook_cells(path):
+    """The markdown and code cells of a Jupyter notebook, as (cell index,
+    source) pairs; outputs, raw cells and metadata are left out. Indexes
+    count every cell, so they match the notebook as Jupyter shows it."""
+    nb = json.loads(path.read_text(encoding='utf-8'))
+    cells = []
+    for i, cell in enumerate(nb.get('cells', [])):
+        if cell.get('cell_type') not in ('markdown', 'code'):
+            continue
+        source = cell.get('source', '')
+        if isinstance(source, list):
+            source = ''.join(source)
+        if source.strip():
+            cells.append((i, source))
+    return cells
+
+class UnreadableDocument(Exception):
+    """A document that can't be extracted; the file is skipped with this reason."""
+
+def docx_text(path):
+    """The paragraphs of a Word document in order, one per line; images and
+    other embedded objects contribute nothing."""
+    try:
+        import docx
+    except ImportError:
+        raise UnreadableDocument("python-docx not installed")
+    try:
+        document = docx.Document(str(path))
+    except Exception:
+        # Corrupt files, and password-protected ones, which are encrypted
+        # containers rather than zip archives
+        raise UnreadableDocument("unreadable docx")
+    return '\n'.join(p.text for p in document.paragraphs)
+
+MAIL_EXTENSIONS = ['.eml', '.mbox']
+
+def mail_body(msg):
+    """A message's body as text, preferring the plain part; HTML-only mail
+    has its tags stripped."""
+    part = msg.get_body(preferencelist=('plain', 'html'))
+    if part is None:
+        return ''
+    try:
+        body = part.get_content()
+    except (LookupError, UnicodeError):
+        body = part.get_payload(decode=True).decode('utf-8', 'replace')
+    if part.get_content_subtype() == 'html':
+        body = re.sub(r'(?s)<(script|style).*?</\1>|<[^>]+>', ' ', body)
+    return body
+
+def mail_messages(path):
+    """The messages in an .eml or .mbox file as (headers, body) pairs, with
+    subject, sender, recipients and date as chunk metadata."""
+    if path.suffix.lower() == '.mbox':
+        box = mailbox.mbox(str(path), factory=lambda f: email.message_from_binary_file(f, policy=email.policy.default),
+                           create=False)
+        msgs = list(box)
+    else:
+        with open(path, 'rb') as f:
+            msgs = [email.message_from_binary_file(f, policy=email.policy.default)]
+    messages = []
+    for msg in msgs:
+        headers = {
+            "mail_subject": str(msg.get('subject', '')),
+            "mail_from": str(msg.get('from', '')),
+            "mail_to": str(msg.get('to', '')),
+            "mail_date": str(msg.get('date', '')),
+        }
+        messages.append((headers, mail_body(msg)))
+    return messages
+
+def chunk_cells(text, chunks, cells):
+    """The first and last notebook cell each chunk draws from. Chunks are
+    slices of text in order, so each is found after the previous one."""
+    starts = []
+    offset = 0
+    for _, source in cells:
+        starts.append(offset)
+        offset += len(source) + len(CELL_SEPARATOR)
+    ranges = []
+    cursor = 0
+    for chunk in chunks:
+        pos = text.find(chunk, cursor)
+        if pos < 0:
+            pos = cursor
+        cursor = pos + 1
+        first = bisect.bisect_right(starts, pos) - 1
+        last = bisect.bisect_right(starts, pos + len(chunk) - 1) - 1
+        ranges.append((cells[max(first, 0)][0], cells[max(last, 0)][0]))
+    return ranges
+
+CHUNK_ID_SCHEMES = ('index', 'content')
+
+def chunk_ids(prefix, chunks, scheme='index'):
+    """IDs for a file's chunks, all starting with its stored path.
+    
+    "index" numbers them (path::0, path::1, ...), so IDs are predictable.
+    "content" uses a hash of each chunk's text, so a chunk keeps its ID as
+    long as its text is unchanged, even if chunks before it come and go;
+    repeated text within a file gets a -2, -3, ... suffix.
+    """
+    if scheme == 'index':
+        return [f"{prefix}::{i}" for i in range(len(chunks))]
+    if scheme != 'content':
+        raise ValueError(f"unknown chunk ID scheme: {scheme}")
+    ids = []
+    seen = {}
+    for chunk in chunks:
+        digest = hashlib.sha1(chunk.encode('utf-8')).hexdigest()[:16]
+        seen[digest] = seen.get(digest, 0) + 1
+        ids.append(f"{prefix}::{digest}" + (f"-{seen[digest]}" if seen[digest] > 1 else ''))
+    return ids
+
+def chunk_hash(text):
+    return hashlib.sha1(text.encode('utf-8')).hexdigest()
+
+def embed_chunks(collection, embedder, chunks, existing_ids=(), reuse=False):
+    """Embeddings for chunks, and how many of them were reused.
+    
+    With reuse, a chunk whose text matches, by content hash, one of the
+    chunks in existing_ids takes that chunk's stored embedding, provided the
+    loaded model revision made it; only the rest are encoded.
+    """
+    stored = {}
+    if reuse and existing_ids:
+        got = collection.get(ids=list(existing_ids), include=["embeddings", "documents", "metadatas"])
+        for text, embedding, meta in zip(got['documents'], got['embeddings'], got['metadatas']):
+            if text is not None and (meta or {}).get('model_revision') == _model_revision:
+                stored[chunk_hash(text)] = list(embedding)
+    
+    hashes = [chunk_hash(c) for c in chunks]
+    fresh = [c for c, h in zip(chunks, hashes) if h not in stored]
+    if fresh:
+        encoded = iter(embedder.encode([_passage_prefix + c for c in fresh]).tolist())
+    embeddings = [stored[h] if h in stored else next(encoded) for h in hashes]
+    return embeddings, len(chunks) - len(fresh)
+
+def load_file(path, encoding='utf-8', frontmatter=''):
+    """Read a file the way index_file indexes it: its text, a notebook's
+    cells or a mailbox's messages, its frontmatter fields if frontmatter is
+    one of FRONTMATTER_MODES, and its hash. Returns a skipped result if it
+    can't be read. This is indexing's disk I/O; it touches no shared state,
+    so index_directory can run it for several files at once.
+    """
+    path = Path(path)
     if not path.exists() or not path.is_file():
         return {"status": "skipped", "reason": "not a file"}
     
-    # Skip binary files
-    try:
-        text = path.read_text(encoding='utf-8')
-    except:
-        return {"status": "skipped", "reason": "not text"}
+    # Notebooks are indexed by their cell sources rather than their JSON
+    cells = messages = None
+    if path.suffix.lower() in MAIL_EXTENSIONS:
+        try:
+            messages = mail_messages(path)
+        except (OSError, ValueError, mailbox.Error):
+            return {"status": "skipped", "reason": "unreadable mail"}
+        text = '\n\n'.join(body for _, body in messages)
+    elif path.suffix.lower() == '.ipynb':
+        try:
+            cells = notebook_cells(path)
+        except (ValueError, UnicodeDecodeError, AttributeError):
+            return {"status": "skipped", "reason": "invalid notebook"}
+        text = CELL_SEPARATOR.join(source for _, source in cells)
+    elif path.suffix.lower() == '.docx':
+        try:
+            text = docx_text(path)
+        except UnreadableDocument as e:
+            return {"status": "skipped", "reason": str(e)}
+    else:
+        # Skip binary files
+        try:
+            text = path.read_text(encoding=encoding)
+        except:
+            return {"status": "skipped", "reason": "not text"}
+    
+    fields = {}
+    if frontmatter and path.suffix.lower() in FRONTMATTER_EXTENSIONS:
+        fields, text = split_frontmatter(text)
+        title = frontmatter_value(fields.get('title', ''))
+        if frontmatter == 'title' and title:
+            text = f"{title}\n\n{text}"
+    
+    return {"status": "loaded", "text": text, "cells": cells, "messages": messages, "fields": fields,
+            "hash": file_hash(path)}
+
+def chunk_file(path, loaded, strategies=None, preprocessors=None):
+    """Chunk a file read by load_file: returns the chunker picked for it,
+    its chunks, metadata particular to each chunk, and the names of the
+    preprocessors that changed anything. Like load_file, safe to run in a
+    worker thread.
+    """
+    text, cells, messages = loaded['text'], loaded['cells'], loaded['messages']
+    chunker = chunker_for(Path(path), strategies)
+    if messages is not None:
+        # Each message is chunked on its own and its chunks carry its headers
+        applied = []
+        chunks, chunk_meta = [], []
+        for headers, body in messages:
+            body, names = preprocess(body, preprocessors)
+            applied += [n for n in names if n not in applied]
+            for chunk in CHUNKERS[chunker](body):
+                chunks.append(chunk)
+                chunk_meta.append(headers)
+    elif cells is not None:
+        # Per cell, so the boundaries are still known afterwards
+        applied = []
+        processed = []
+        for i, source in cells:
+            source, names = preprocess(source, preprocessors)
+            applied += [n for n in names if n not in applied]
+            if source.strip():
+                processed.append((i, source))
+        text = CELL_SEPARATOR.join(source for _, source in processed)
+        chunks = CHUNKERS[chunker](text)
+        chunk_meta = [{"cell_idx": first, "cell_end": last} for first, last in chunk_cells(text, chunks, processed)]
+    else:
+        text, applied = preprocess(text, preprocessors)
+        chunks = CHUNKERS[chunker](text)
+        chunk_meta = [{}] * len(chunks)
+    return chunker, chunks, chunk_meta, applied
+
+def index_file(collection, embedder, file_path, force=False, strategies=None, tags=None, preprocessors=None,
+               name=None, root=None, id_scheme='index', reuse=False, encoding='utf-8', frontmatter='',
+               archive=None, loaded=None):
+    """Index a single file, skipping if unchanged.
+    
+    Indexing replaces whatever chunks the stored path already had, so it can
+    be repeated safely; force only skips the unchanged check.
+    
+    name, if given, is a logical path stored in place of the file's own, so
+    re-indexing under the same name replaces the earlier chunks. root is the
+    directory being indexed; the path relative to it is stored for display.
+    id_scheme picks how chunk IDs are derived; see chunk_ids. With reuse,
+    only chunks whose text changed since the last index are embedded; see
+    embed_chunks. encoding is the codec plain-text files are decoded with;
+    notebooks, mail and documents carry their own. frontmatter, one of
+    FRONTMATTER_MODES, has a markdown file's frontmatter stored as fm:<key>
+    metadata instead of indexed as text, its tags added to the file's.
+    archive is set for an archive entry extracted to file_path: the
+    archive's path, stored with the entry's name; see index_archive.
+    loaded is the file as load_file already read it, possibly with its
+    chunk_file result under "chunked"; otherwise it is read here. tags
+    replace the file's tags; None keeps them (see kept_tags).
+    """
+    path = Path(file_path)
+    if loaded is None:
+        loaded = load_file(path, encoding, frontmatter)
+    if loaded['status'] == 'skipped':
+        return loaded
+    text, fields = loaded['text'], loaded['fields']
+    stored_path = name or str(path.absolute())
+    
+    # Empty and whitespace-only files have nothing to embed; drop whatever
+    # the file held when it was last indexed
+    if not text.strip():
+        stale = collection.get(where={"path": stored_path}, include=[])['ids']
+        if stale:
+            retry_locked(collection.delete, ids=stale)
+        return {"status": "skipped", "reason": "empty"}
     
     # Check if already indexed with same hash
-    current_hash = file_hash(file_path)
-    doc_id_prefix = str(path.absolute())
+    current_hash = loaded['hash']
+    preprocess_sig = preprocessors_signature(preprocessors)
+    rel_path = os.path.relpath(stored_path, root) if root else (name or path.name)
+    doc_id_prefix = stored_path
     
     # Check existing
-    existing = collection.get(where={"path": str(path.absolute())})
+    existing = collection.get(where={"path": stored_path})
+    manual = kept_tags(tags, existing['metadatas'])
+    tags = list(manual or []) + [t for t in frontmatter_tags(fields) if t not in (manual or [])]
+    tag_list = tags_value(tags)
     if existing['ids'] and not force:
-        if existing['metadatas'] and existing['metadatas'][0].get('hash') == current_hash:
+        # A trashed file that reappears is re-added rather than skipped
+        # So is one indexed again with different tags, preprocessors, encoding
+        # or frontmatter handling
+        if existing['metadatas'] and existing['metadatas'][0].get('hash') == current_hash \
+                and existing['metadatas'][0].get('tags', '') == tag_list \
+                and existing['metadatas'][0].get('preprocess_sig', '') == preprocess_sig \
+                and existing['metadatas'][0].get('encoding', 'utf-8') == encoding \
+                and existing['metadatas'][0].get('frontmatter', '') == frontmatter \
+                and not is_trashed(existing['metadatas'][0]):
             return {"status": "skipped", "reason": "unchanged"}
-        # Delete old entries
-        collection.delete(ids=existing['ids'])
     
-    # Chunk and embed
-    chunks = chunk_text(text)
+    # Chunk; chunk_meta holds metadata particular to each chunk
+    chunker, chunks, chunk_meta, applied = loaded.get('chunked') or chunk_file(path, loaded, strategies, preprocessors)
+    # Preprocessing can leave nothing behind
     if not chunks:
+        if existing['ids']:
+            retry_locked(collection.delete, ids=existing['ids'])
         return {"status": "skipped", "reason": "empty"}
     
-    embeddings = embedder.encode(chunks).tolist()
+    embeddings, reused = embed_chunks(collection, embedder, chunks, existing['ids'], reuse)
+    
+    # Replace every chunk the path had, not just the IDs about to be reused,
+    # so a file that shrank doesn't keep its old tail. Only now that the
+    # embedding succeeded, so a failure leaves the old chunks searchable.
+    if existing['ids']:
+        retry_locked(collection.delete, ids=existing['ids'])
     
     # Store
-    ids = [f"{doc_id_prefix}::{i}" for i in range(len(chunks))]
+    ids = chunk_ids(doc_id_prefix, chunks, id_scheme)
+    indexed_at = time.time()
     metadatas = [
         {
-            "path": str(path.absolute()),
-            "filename": path.name,
+            "path": stored_path,
+            "rel_path": rel_path,
+            "filename": Path(stored_path).name,
             "chunk_idx": i,
-            "hash": current_hash
+            "hash": current_hash,
+            "file_size": path.stat().st_size,
+            "mtime": path.stat().st_mtime,
+            "indexed_at": indexed_at,
+            "file_chunks": len(chunks),
+            "chunker": chunker,
+            "model_revision": _model_revision,
+            "tags": tag_list,
+            "manual_tags": tags_value(manual),
+            "preprocessors": ','.join(applied),
+            "preprocess_sig": preprocess_sig,
+            "encoding": encoding,
+            "frontmatter": frontmatter,
+            **({"archive": archive, "entry": stored_path[len(archive) + 1:]} if archive else {}),
+            **{f"fm:{k}": frontmatter_value(v) for k, v in fields.items() if v},
+            **chunk_meta[i],
+            **tag_keys(tags)
         }
         for i in range(len(chunks))
     ]
     
-    collection.add(
+    retry_locked(collection.add,
         ids=ids,
         embeddings=embeddings,
         documents=chunks,
         metadatas=metadatas
     )
     
-    return {"status": "indexed", "chunks": len(chunks), "path": str(path)}
+    return {
+        "status": "indexed", "chunks": len(chunks), "replaced": len(existing['ids']), "path": str(path),
+        "reused": reused, "embedded": len(chunks) - reused
+    }
+
+# The chunker recorded for chunks indexed with --stdin-jsonl, whose path
+# needn't be a file: nothing checks it against the disk
+EXTERNAL_CHUNKER = 'external'
+
+def index_chunks(collection, embedder, path, chunks, force=False, tags=None, id_scheme='index'):
+    """Index text that was chunked elsewhere, stored under path as-is.
+    
+    chunks are {"text": ..., "meta": {...}} objects, embedded without
+    preprocessing or re-chunking; blank ones are dropped. As with index_file, whatever chunks path
+    had are replaced, and unless force nothing is done when the texts,
+    metadata and tags are unchanged. meta values must be strings, numbers
+    or booleans; the keys index_file sets take precedence over them.
+    """
+    if not path:
+        raise ValueError("index_chunks needs a path")
+    chunks = [c for c in chunks if (c.get('text') or '').strip()]
+    texts = [c['text'] for c in chunks]
+    extra = [c.get('meta') or {} for c in chunks]
+    for meta in extra:
+        for key, value in meta.items():
+            if not isinstance(value, (str, int, float, bool)):
+                raise ValueError(f"{path}: meta {key!r} must be a string, number or boolean")
+    if not texts:
+        stale = collection.get(where={"path": path}, include=[])['ids']
+        if stale:
+            retry_locked(collection.delete, ids=stale)
+        return {"status": "skipped", "reason": "empty", "path": path}
+    
+    current_hash = chunk_hash(json.dumps([texts, extra], sort_keys=True))
+    existing = collection.get(where={"path": path}, include=["metadatas"])
+    tags = kept_tags(tags, existing['metadatas'])
+    tag_list = tags_value(tags)
+    if existing['ids'] and not force:
+        meta = existing['metadatas'][0]
+        if meta.get('hash') == current_hash and meta.get('tags', '') == tag_list and not is_trashed(meta):
+            return {"status": "skipped", "reason": "unchanged", "path": path}
+    
+    embeddings, _ = embed_chunks(collection, embedder, texts)
+    if existing['ids']:
+        retry_locked(collection.delete, ids=existing['ids'])
+    
+    indexed_at = time.time()
+    metadatas = [
+        {
+            **extra[i],
+            "path": path,
+            "rel_path": path,
+            "filename": Path(path).name,
+            "chunk_idx": i,
+            "hash": current_hash,
+            "file_size": sum(len(t.encode('utf-8')) for t in texts),
+            "indexed_at": indexed_at,
+            "file_chunks": len(texts),
+            "chunker": EXTERNAL_CHUNKER,
+            "model_revision": _model_revision,
+            "tags": tag_list,
+            **tag_keys(tags)
+        }
+        for i in range(len(texts))
+    ]
+    retry_locked(collection.add,
+        ids=chunk_ids(path, texts, id_scheme),
+        embeddings=embeddings,
+        documents=texts,
+        metadatas=metadatas
+    )
+    return {"status": "indexed", "chunks": len(texts), "replaced": len(existing['ids']), "path": path}
+
+def reembed_chunks(collection, embedder, path):
+    """Re-embed path's stored chunk texts in place, for chunks indexed with
+    index_chunks, which have no file to read them from again."""
+    found = collection.get(where={"path": path}, include=["documents", "metadatas"])
+    live = [(i, d, m) for i, d, m in zip(found['ids'], found['documents'], found['metadatas']) if not is_trashed(m)]
+    if not live:
+        return {"status": "skipped", "reason": "no chunks"}
+    ids, texts, metadatas = map(list, zip(*live))
+    embeddings, _ = embed_chunks(collection, embedder, texts)
+    now = time.time()
+    metadatas = [{**m, "model_revision": _model_revision, "indexed_at": now} for m in metadatas]
+    retry_locked(collection.update, ids=ids, embeddings=embeddings, metadatas=metadatas)
+    return {"status": "indexed", "chunks": len(ids)}
+
+def walk_files(dir_path, follow_symlinks=False, max_depth=None):
+    """Yield every file under dir_path.
+    
+    Symlinked directories are only descended into with follow_symlinks, and
+    each directory is visited once, keyed by (device, inode), so a symlink
+    loop can't recurse forever. Symlinked files are yielded under the link's
+    own path; reading them reads the target. max_depth, if not None, limits
+    how many directory levels below dir_path are walked; 0 yields only
+    dir_path's own files.
+    """
+    visited = set()
+    for root, dirnames, filenames in os.walk(dir_path, followlinks=follow_symlinks):
+        if max_depth is not None and len(Path(root).relative_to(dir_path).parts) >= max_depth:
+            dirnames[:] = []
+        try:
+            st = os.stat(root)
+        except OSError:
+            dirnames[:] = []
+            continue
+        key = (st.st_dev, st.st_ino)
+        if key in visited:
+            dirnames[:] = []
+            continue
+        visited.add(key)
+        for name in filenames:
+            yield Path(root) / name
+
+DEFAULT_EXTENSIONS = ['.md', '.txt', '.py', '.go', '.js', '.ts', '.json', '.yaml', '.yml', '.ipynb', '.docx']
+
+def index_extensions(extensions=None, mail=False, archives=False):
+    """The extensions to index: those asked for, or the defaults plus mail
+    archives with --mail, which are opt-in since mailboxes are often large
+    and private. With --archives, zip and tar archives are added either way,
+    and their entries are picked from the rest."""
+    if not extensions:
+        extensions = DEFAULT_EXTENSIONS + (MAIL_EXTENSIONS if mail else [])
+    return extensions + (ARCHIVE_EXTENSIONS if archives else [])
+
+# .gz for .tar.gz; is_archive tells tarballs from other gzipped files
+ARCHIVE_EXTENSIONS = ['.zip', '.tar', '.tgz', '.gz']
+
+# Larger entries are skipped rather than read into memory
+MAX_ARCHIVE_ENTRY = 50 * 1024 * 1024
+
+def is_archive(path):
+    return str(path).lower().endswith(('.zip', '.tar', '.tgz', '.tar.gz'))
+
+def archive_entries(path):
+    """Yield (name, mtime, size, read) for each regular file in a zip or tar
+    archive; read() returns the entry's bytes."""
+    if str(path).lower().endswith('.zip'):
+        with zipfile.ZipFile(path) as z:
+            for info in z.infolist():
+                if not info.is_dir():
+                    mtime = time.mktime(info.date_time + (0, 0, -1))
+                    yield info.filename, mtime, info.file_size, lambda info=info: z.read(info)
+    else:
+        with tarfile.open(path) as t:
+            for info in t:
+                if info.isfile():
+                    yield info.name, info.mtime, info.size, lambda info=info: t.extractfile(info).read()
+
+def index_archive(collection, embedder, archive_path, extensions, root=None, force=False, entries=None, **options):
+    """Index the entries of a zip or tar archive, each stored under the path
+    <archive>!<entry>, with the archive and entry also in its metadata.
+    
+    Entries are chosen like the files of a directory, by extension and
+    leaving out hidden ones, or given by name in entries; archives inside
+    are not opened. Each is written to a temporary file, keeping its mtime,
+    and indexed from there with index_file, which gets force and options.
+    Chunks of entries no longer in the archive are trashed.
+    
+    Returns one result per entry and the number of entries trashed.
+    """
+    archive_path = str(Path(archive_path).absolute())
+    extensions = extensions or DEFAULT_EXTENSIONS
+    results = []
+    names = set()
+    try:
+        with tempfile.TemporaryDirectory() as tmp:
+            for name, mtime, size, read in archive_entries(archive_path):
+                names.add(name)
+                entry = PurePosixPath(name)
+                if entries is not None:
+                    if name not in entries:
+                        continue
+                elif entry.suffix.lower() not in extensions or entry.suffix.lower() in ARCHIVE_EXTENSIONS \
+                        or is_ignored(entry.parts):
+                    continue
+                if _shutdown_requested:
+                    return results, 0
+                stored = f"{archive_path}!{name}"
+                if size > MAX_ARCHIVE_ENTRY:
+                    results.append({"status": "skipped", "reason": "too large", "path": stored})
+                    continue
+                extracted = os.path.join(tmp, entry.name)
+                with open(extracted, 'wb') as f:
+                    f.write(read())
+                os.utime(extracted, (mtime, mtime))
+                result = index_file(
+                    collection, embedder, extracted, force, name=stored, root=root, archive=archive_path, **options
+                )
+                os.remove(extracted)
+                results.append({**result, "path": stored})
+    except (OSError, EOFError, zipfile.BadZipFile, tarfile.TarError) as e:
+        return [{"status": "skipped", "reason": f"unreadable archive: {e}", "path": archive_path}], 0
+    
+    existing = collection.get(where={"archive": archive_path}, include=["metadatas"])
+    now = int(time.time())
+    ids, metadatas, gone = [], [], set()
+    for chunk_id, meta in zip(existing['ids'], existing['metadatas']):
+        if not is_trashed(meta) and meta.get('entry') not in names:
+            ids.append(chunk_id)
+            metadatas.append({**meta, "deleted_at": now})
+            gone.add(meta['path'])
+    if ids:
+        retry_locked(collection.update, ids=ids, metadatas=metadatas)
+    return results, len(gone)
+
+def is_ignored(parts):
+    """Whether a path, by its parts, is hidden or in a common ignore
+    directory."""
+    return any(part.startswith('.') for part in parts) or 'node_modules' in parts or '__pycache__' in parts
 
-def index_directory(collection, embedder, dir_path, extensions=None, force=False):
-    """Recursively index a directory."""
+def indexable_files(dir_path, extensions=None, follow_symlinks=False, max_depth=None):
+    """Yield the files under dir_path that index_directory would index."""
     if extensions is None:
-        extensions = ['.md', '.txt', '.py', '.go', '.js', '.ts', '.json', '.yaml', '.yml']
+        extensions = DEFAULT_EXTENSIONS
+    
+    for path in walk_files(dir_path, follow_symlinks, max_depth):
+        if path.is_file() and path.suffix.lower() in extensions and not is_ignored(path.parts):
+            yield path
+
+def estimate_chunks(size, chunk_size=500, overlap=50):
+    """Rough chunk count for a file of size bytes, matching chunk_text's stride."""
+    return max(1, -(-size // (chunk_size - overlap)))
+
+def scan_path(path, extensions=None, follow_symlinks=False, max_depth=None):
+    """Count what indexing a file or directory would touch, without reading any file."""
+    path = Path(path)
+    paths = indexable_files(path, extensions, follow_symlinks, max_depth) if path.is_dir() else [path]
+    files = chunks = 0
+    for p in paths:
+        files += 1
+        chunks += estimate_chunks(p.stat().st_size)
+    return {"status": "ok", "count": files, "chunks": chunks}
+
+def prefetched(items, load, workers):
+    """Yield (item, load(item)) for each of items in order, with up to
+    workers of the following items loading in background threads meanwhile.
+    Loads not yet started when the caller stops early are cancelled.
+    """
+    pool = ThreadPoolExecutor(workers)
+    pending = deque()
+    try:
+        for item in items:
+            pending.append((item, pool.submit(load, item)))
+            if len(pending) > workers:
+                item, future = pending.popleft()
+                yield item, future.result()
+        while pending:
+            item, future = pending.popleft()
+            yield item, future.result()
+    finally:
+        pool.shutdown(cancel_futures=True)
+
+def index_directory(collection, embedder, dir_path, extensions=None, force=False, follow_symlinks=False,
+                    strategies=None, tags=None, preprocessors=None, id_scheme='index', max_depth=None,
+                    only_new=False, reuse=False, encoding='utf-8', frontmatter='', archives=False,
+                    max_concurrent_files=1):
+    """Recursively index a directory, at most max_depth levels down if given.
+    
+    With only_new, files that already have chunks are left alone without
+    being read or hashed, and counted as present. reuse, encoding and
+    frontmatter are passed on to index_file. With archives, zip and tar
+    archives are indexed entry by entry (see index_archive), and dir_path
+    may be an archive itself.
     
-    results = {"indexed": 0, "skipped": 0, "files": []}
+    With max_concurrent_files above 1, that many files ahead are read, and
+    chunked unless their stored hash says they're unchanged, in worker
+    threads while the current one is embedded. Everything touching the
+    collection stays on this thread, in path order, so what's stored is
+    the same as without.
+    """
+    results = {"indexed": 0, "skipped": 0, "chunks": 0, "present": 0, "reused": 0, "embedded": 0, "files": []}
     dir_path = Path(dir_path)
+    root = str(dir_path.absolute() if dir_path.is_dir() else dir_path.absolute().parent)
+    present = indexed_paths(collection) if only_new else {}
+    present_archives = {meta.get('archive') for meta in present.values()}
+    options = dict(
+        strategies=strategies, tags=tags, preprocessors=preprocessors, id_scheme=id_scheme, reuse=reuse,
+        encoding=encoding, frontmatter=frontmatter
+    )
+    paths = indexable_files(dir_path, extensions, follow_symlinks, max_depth) if dir_path.is_dir() else [dir_path]
+    archive_trashed = 0
     
-    for path in dir_path.rglob('*'):
-        if path.is_file() and path.suffix.lower() in extensions:
-            # Skip hidden and common ignore patterns
-            if any(part.startswith('.') for part in path.parts):
-                continue
-            if 'node_modules' in path.parts or '__pycache__' in path.parts:
-                continue
-            
-            result = index_file(collection, embedder, str(path), force)
+    def is_present(path):
+        return str(path.absolute()) in present or str(path.absolute()) in present_archives
+    
+    # The workers can't ask the collection, so they go by a snapshot of the
+    # stored hashes; a file they wrongly take as unchanged is chunked later
+    stored = (present or indexed_paths(collection)) if max_concurrent_files > 1 else {}
+    
+    def load(path):
+        if is_present(path) or archives and is_archive(path):
+            return None
+        loaded = load_file(path, encoding, frontmatter)
+        meta = stored.get(str(path.absolute()))
+        if loaded['status'] == 'loaded' and (force or not meta or meta.get('hash') != loaded['hash']):
+            loaded['chunked'] = chunk_file(path, loaded, strategies, preprocessors)
+        return loaded
+    
+    if max_concurrent_files > 1:
+        loads = prefetched(paths, load, max_concurrent_files)
+    else:
+        loads = ((path, None) for path in paths)
+    for path, loaded in loads:
+        if _shutdown_requested:
+            break
+        if is_present(path):
+            results['present'] += 1
+            continue
+        if archives and is_archive(path):
+            files, trashed = index_archive(collection, embedder, path, extensions, root, force, **options)
+            archive_trashed += trashed
+        else:
+            files = [index_file(collection, embedder, str(path), force, root=root, loaded=loaded, **options)]
+        for result in files:
             if result['status'] == 'indexed':
                 results['indexed'] += 1
+                results['chunks'] += result['chunks']
+                results['reused'] += result['reused']
+                results['embedded'] += result['embedded']
             else:
                 results['skipped'] += 1
             results['files'].append(result)
     
+    if not _shutdown_requested:
+        results['trashed'] = trash_missing(collection, str(dir_path.absolute())) + archive_trashed
+    
+    return results
+
+def indexed_paths(collection, batch_size=1000):
+    """The stored path of every file with live chunks, each mapped to one of
+    its chunks' metadata."""
+    files = {}
+    offset = 0
+    while True:
+        page = collection.get(limit=batch_size, offset=offset, include=["metadatas"])
+        if not page['ids']:
+            break
+        offset += len(page['ids'])
+        for meta in page['metadatas']:
+            if meta and meta.get('path') and not is_trashed(meta):
+                files.setdefault(meta['path'], meta)
+    return files
+
+def stored_root(path, rel_path):
+    """The directory a file was indexed under, recovered from its stored
+    relative path, or None if they don't line up."""
+    parts, rel = Path(path).parts, Path(rel_path or '').parts
+    if rel and parts[-len(rel):] == rel:
+        return str(Path(path).parents[len(rel) - 1])
+    return None
+
+def reindex_progress_path(collection):
+    return os.path.join(_db_path, f"reindex-{collection.name}.json")
+
+def reindex(collection, embedder, resume=False, strategies=None, preprocessors=None, id_scheme='index'):
+    """Re-embed every indexed file, e.g. after a model change.
+    
+    Files go in sorted path order, and the last one finished is recorded in
+    the db directory after each, so resume can skip what an interrupted run
+    already did; without it, a run starts over. The record is removed once
+    a run completes. Each file keeps its tags, the root its relative path
+    was stored against, the encoding it was read with and its frontmatter
+    handling. Archive entries are read from their archive again, and chunks
+    from --stdin-jsonl are re-embedded from their stored text. Logical paths
+    stored with --name, and files that no longer exist, can't be re-read and
+    are skipped.
+    """
+    progress_path = reindex_progress_path(collection)
+    last = None
+    if resume:
+        try:
+            with open(progress_path) as f:
+                last = json.load(f).get('last')
+        except (OSError, ValueError):
+            pass
+    
+    files = indexed_paths(collection)
+    results = {"indexed": 0, "skipped": 0, "chunks": 0, "count": len(files), "resumed": 0}
+    for path in sorted(files):
+        if last is not None and path <= last:
+            results['resumed'] += 1
+            continue
+        if _shutdown_requested:
+            break
+        meta = files[path]
+        result = {"status": "skipped"}
+        options = dict(
+            strategies=strategies, tags=None, preprocessors=preprocessors,
+            root=stored_root(path, meta.get('rel_path')), id_scheme=id_scheme,
+            encoding=meta.get('encoding', 'utf-8'), frontmatter=meta.get('frontmatter', '')
+        )
+        if meta.get('chunker') == EXTERNAL_CHUNKER:
+            result = reembed_chunks(collection, embedder, path)
+        elif meta.get('archive'):
+            entries, _ = index_archive(
+                collection, embedder, meta['archive'], None, force=True, entries={meta['entry']}, **options
+            )
+            result = entries[0] if entries else result
+        elif os.path.isabs(path):
+            result = index_file(collection, embedder, path, True, **options)
+        if result['status'] == 'indexed':
+            results['indexed'] += 1
+            results['chunks'] += result['chunks']
+        else:
+            results['skipped'] += 1
+        with open(progress_path, 'w') as f:
+            json.dump({"last": path}, f)
+    else:
+        if os.path.exists(progress_path):
+            os.remove(progress_path)
     return results
 
-def search(collection, embedder, query, limit=5):
-    """Semantic search over indexed content."""
-    query_embedding = embedder.encode([query]).tolist()
+def kept_tags(tags, metadatas):
+    """The --tag tags to index a file with: tags if given, even empty, else
+    the ones it was last given, so re-indexing without --tag neither strips
+    them nor counts them as a change.
+    
+    Frontmatter tags aren't kept: they're read from the file every time, so
+    one removed there goes. Files indexed before the two were stored apart
+    have the frontmatter's tags told apart by their fm:tags value.
+    """
+    if tags is not None or not metadatas:
+        return tags
+    meta = metadatas[0]
+    if 'manual_tags' in meta:
+        return [t for t in meta['manual_tags'].split(',') if t]
+    from_frontmatter = frontmatter_tags({'tags': meta.get('fm:tags', '')})
+    return [t for t in meta.get('tags', '').split(',') if t and t not in from_frontmatter]
+
+def tags_value(tags):
+    """The tags metadata string: sorted and comma-separated, for display."""
+    return ','.join(sorted(set(tags or [])))
+
+def tag_keys(tags):
+    """One boolean key per tag. Chroma can't filter on list values or
+    substrings of metadata, so tags are matched through these keys."""
+    return {f"tag:{t}": True for t in (tags or [])}
+
+def remove_by_tag(collection, tag):
+    """Delete every chunk carrying tag; returns how many were removed."""
+    ids = collection.get(where={f"tag:{tag}": True}, include=[])['ids']
+    if ids:
+        retry_locked(collection.delete, ids=ids)
+    return len(ids)
+
+def rfc3339(timestamp):
+    """A stored epoch timestamp as RFC 3339 UTC, or '' for chunks indexed
+    before it was recorded."""
+    if not timestamp:
+        return ''
+    return datetime.fromtimestamp(timestamp, timezone.utc).strftime('%Y-%m-%dT%H:%M:%SZ')
+
+def is_trashed(meta):
+    return bool(meta.get('deleted_at'))
+
+def is_under(path, root):
+    """Whether path is root itself or lies inside it.
+    
+    Both are normalized first, so on Windows separators and letter case
+    don't matter (C:/Notes matches c:\\notes\\a.md); elsewhere only
+    redundant separators and . components are dropped.
+    """
+    path = os.path.normcase(os.path.normpath(path))
+    root = os.path.normcase(os.path.normpath(root))
+    return path == root or path.startswith(root.rstrip(os.sep) + os.sep)
+
+def trashed_ids(collection):
+    return collection.get(where={"deleted_at": {"$gt": 0}}, include=[])['ids']
+
+def trash_missing(collection, dir_path):
+    """Soft-delete chunks of files under dir_path that no longer exist.
+    
+    Chunks get a deleted_at timestamp instead of being removed, so a file
+    that was only moved away temporarily can be restored. Returns the number
+    of files trashed.
+    """
+    existing = collection.get(include=["metadatas"])
+    now = int(time.time())
+    exists = {}
+    ids, metadatas, files = [], [], set()
+    for chunk_id, meta in zip(existing['ids'], existing['metadatas']):
+        path = meta.get('path', '')
+        if is_trashed(meta) or meta.get('chunker') == EXTERNAL_CHUNKER or not is_under(path, dir_path):
+            continue
+        if path not in exists:
+            # An archive entry is there as long as its archive is; entries
+            # dropped from it are trashed by index_archive
+            exists[path] = os.path.exists(meta.get('archive') or path)
+        if exists[path]:
+            continue
+        ids.append(chunk_id)
+        metadatas.append({**meta, "deleted_at": now})
+        files.add(path)
+    if ids:
+        retry_locked(collection.update, ids=ids, metadatas=metadatas)
+    return len(files)
+
+def restore(collection, path):
+    """Un-delete trashed chunks for a file, or for every file under a directory."""
+    existing = collection.get(where={"deleted_at": {"$gt": 0}}, include=["metadatas"])
+    ids, metadatas = [], []
+    for chunk_id, meta in zip(existing['ids'], existing['metadatas']):
+        if is_under(meta.get('path', ''), path):
+            ids.append(chunk_id)
+            metadatas.append({**meta, "deleted_at": 0})
+    if ids:
+        retry_locked(collection.update, ids=ids, metadatas=metadatas)
+    return len(ids)
+
+def empty_trash(collection):
+    """Permanently remove all trashed chunks."""
+    ids = trashed_ids(collection)
+    if ids:
+        retry_locked(collection.delete, ids=ids)
+    return len(ids)
+
+REQUIRED_METADATA = ('path', 'filename', 'chunk_idx', 'hash')
+
+def verify(collection, embedder, fix=False, batch_size=1000):
+    """Check every chunk for a usable embedding of the model's dimension,
+    the metadata search and re-indexing rely on, some text, and a file that
+    still exists. Trashed chunks are expected to lack their file, and paths
+    stored with --name or --stdin-jsonl are logical, so none of these is
+    checked against the disk.
+    
+    Each file's chunks are also counted against the file_chunks total they
+    were stored with, which an interrupted or partly failed insert leaves
+    wrong; every chunk of such a file counts as incomplete_file.
+    
+    Returns the number of chunks checked, a count per anomaly, the number of
+    chunks the per-file totals add up to, the collection's own count, and
+    with fix the number of chunks deleted for having any anomaly.
+    """
+    dimension = len(embedder.encode(['dimension check'])[0])
+    anomalies = {"missing_embedding": 0, "wrong_dimension": 0, "missing_metadata": 0,
+                 "empty_text": 0, "missing_file": 0, "incomplete_file": 0}
+    bad = []
+    # (path, trashed) -> chunk IDs and the file_chunks values they carry
+    files = {}
+    checked = 0
+    offset = 0
+    while True:
+        found = collection.get(limit=batch_size, offset=offset, include=["embeddings", "metadatas", "documents"])
+        if not found['ids']:
+            break
+        offset += len(found['ids'])
+        embeddings = found['embeddings']
+        if embeddings is None:
+            embeddings = [None] * len(found['ids'])
+        for chunk_id, embedding, meta, text in zip(found['ids'], embeddings, found['metadatas'], found['documents']):
+            checked += 1
+            meta = meta or {}
+            problem = None
+            if embedding is None or len(embedding) == 0:
+                problem = "missing_embedding"
+            elif len(embedding) != dimension:
+                problem = "wrong_dimension"
+            elif any(meta.get(k) is None for k in REQUIRED_METADATA):
+                problem = "missing_metadata"
+            elif not (text or '').strip():
+                problem = "empty_text"
+            elif not is_trashed(meta) and os.path.isabs(meta['path']) and meta.get('chunker') != EXTERNAL_CHUNKER \
+                    and not os.path.exists(meta.get('archive') or meta['path']):
+                problem = "missing_file"
+            if problem:
+                anomalies[problem] += 1
+                bad.append(chunk_id)
+            if meta.get('path'):
+                ids, totals = files.setdefault((meta['path'], is_trashed(meta)), ([], set()))
+                ids.append(chunk_id)
+                totals.add(meta.get('file_chunks') or 0)
     
-    results = collection.query(
-        query_embeddings=query_embedding,
-        n_results=limit,
-        include=["documents", "metadatas", "distances"]
+    # Chunks from before file_chunks was stored can only vouch for themselves
+    expected = 0
+    flagged = set(bad)
+    for ids, totals in files.values():
+        total = max(totals) or len(ids)
+        expected += total
+        if len(totals) > 1 or len(ids) != total:
+            anomalies["incomplete_file"] += len(ids)
+            bad.extend(i for i in ids if i not in flagged)
+    
+    total = collection.count()
+    removed = 0
+    if fix and bad:
+        for i in range(0, len(bad), batch_size):
+            retry_locked(collection.delete, ids=bad[i:i + batch_size])
+        removed = len(bad)
+    return checked, anomalies, expected, total, removed
+
+def configured_ef_search(collection):
+    """The HNSW query-time ef the collection is configured with.
+    
+    Newer Chroma keeps it in the collection's configuration, older releases
+    in its metadata; a collection that never set it has the HNSW default.
+    """
+    for attr in ('configuration', 'configuration_json'):
+        try:
+            config = getattr(collection, attr, None)
+        except Exception:
+            continue
+        if isinstance(config, dict):
+            hnsw = config.get('hnsw') or config.get('hnsw_configuration') or {}
+            if isinstance(hnsw, dict) and hnsw.get('ef_search'):
+                return hnsw['ef_search']
+    return (collection.metadata or {}).get("hnsw:search_ef", HNSW_DEFAULTS["hnsw:search_ef"])
+
+def set_ef_search(collection, ef_search):
+    """Set HNSW query-time ef in the collection's configuration.
+    
+    Older Chroma releases only take it as metadata, next to hnsw:space,
+    which modify refuses or drops; rather than risk the distance metric,
+    they raise.
+    """
+    try:
+        collection.modify(configuration={"hnsw": {"ef_search": ef_search}})
+    except TypeError:
+        raise ValueError(
+            "this Chroma release can't change ef_search on an existing collection; "
+            "drop --ef-search (and \"ef_search\" in config.json) or upgrade chromadb"
+        )
+
+def apply_ef_search(collection, ef_search):
+    """Store ef_search as the collection's query-time ef if it differs.
+    
+    Chroma has no per-query ef, so --ef-search is collection configuration,
+    written by the index commands; searches only ever read it.
+    """
+    if ef_search and ef_search != configured_ef_search(collection):
+        set_ef_search(collection, ef_search)
+
+def search(collection, embedder, query, limit=5, snippets=False, half_life=None, with_text=True, score_weights=None,
+           keyword_mode=''):
+    """Semantic search over indexed content, boosting recent chunks if
+    half_life is given, or ranking by score_weights (see search_vector).
+    With a keyword_mode, vector and keyword matches are fused into a hybrid
+    ranking (see hybrid_results).
+    
+    Returns the results, the query time in ms and the collection's
+    ef_search. Without with_text, results carry no text, and so no snippets.
+    """
+    query_embedding = embedder.encode([_query_prefix + query])[0].tolist()
+    results, query_ms, ef_search = search_vector(
+        collection, query_embedding, limit * RECENCY_POOL if keyword_mode else limit, half_life=half_life,
+        with_text=with_text, score_weights=score_weights
     )
+    if keyword_mode:
+        results = hybrid_results(collection, query, keyword_mode, results, limit, with_text)
+    if snippets and with_text:
+        add_snippets(embedder, query_embedding, results)
+    return results, query_ms, ef_search
+
+def score_header(collection, half_life=None, score_weights=None, keyword_mode=''):
+    """Describe what a result's score means, for self-describing JSON.
+    
+    Scores are 1 - distance under the collection's metric, so higher is
+    better whichever metric it is, decayed by age under a recency boost or
+    blended with metadata signals under score_weights. A hybrid search
+    scores by rank instead.
+    """
+    metric = (collection.metadata or {}).get("hnsw:space", "l2")
+    score = "1 - distance"
+    if score_weights:
+        terms = [f"{score_weights.get('vector', 1.0):g} * (1 - distance)"]
+        for key, weight in sorted(score_weights.items()):
+            if key == 'recency':
+                terms.append(f"{weight:g} * 0.5^(age_days / {half_life or DEFAULT_HALF_LIFE:g})")
+            elif key != 'vector':
+                terms.append(f"{weight:g} * [{key}]")
+        score = " + ".join(terms)
+    elif half_life:
+        score = f"(1 - distance) * 0.5^(age_days / {half_life:g})"
+    if keyword_mode:
+        score = f"1/({RRF_K} + vector rank) + 1/({RRF_K} + {keyword_mode} keyword rank), vector rank by {score}"
+    return {"model": MODEL_NAME, "metric": metric, "score": score, "higher_is_better": True}
+
+def cap_text(results, budget):
+    """Cut result texts so together they fit in budget bytes of UTF-8, which
+    keeps a response line bounded however large the chunks are. Results are
+    taken in order: the one that crosses the budget is cut short, any after
+    it lose their text, and each is marked text_truncated.
+    
+    Returns the budget left, for a stream to carry over; None means no cap.
+    """
+    if budget is None:
+        return None
+    for r in results:
+        data = r.get('text', '').encode('utf-8')
+        if len(data) <= budget:
+            budget -= len(data)
+            continue
+        r['text'] = data[:budget].decode('utf-8', 'ignore')
+        r['text_truncated'] = True
+        budget = 0
+    return budget
+
+def select_fields(results, fields):
+    """Keep only the requested keys of each result; no fields keeps all."""
+    if not fields:
+        return results
+    return [{k: v for k, v in r.items() if k in fields} for r in results]
+
+def stream_search(collection, embedder, query, limit=5, snippets=False, half_life=None, fields=None,
+                  score_weights=None):
+    """Like search(), but yields one message per result and then a final
+    status message, so the caller can print results as they arrive.
+    
+    Snippets are the slow part of a large result set, so they're computed
+    per result rather than in one batch up front.
+    """
+    query_embedding = embedder.encode([_query_prefix + query])[0].tolist()
+    results, query_ms, ef_search = search_vector(
+        collection, query_embedding, limit, half_life=half_life, score_weights=score_weights
+    )
+    budget = _max_text_bytes
+    for result in results:
+        if snippets:
+            add_snippets(embedder, query_embedding, [result])
+        budget = cap_text([result], budget)
+        yield {"status": "result", "results": select_fields([result], fields)}
+    yield {"status": "ok", "query_ms": query_ms, "ef_search": ef_search, "warnings": prefix_mismatches(collection),
+           "header": score_header(collection, half_life, score_weights)}
+
+def split_sentences(text):
+    return [s.strip() for s in re.split(r'(?<=[.!?])\s+|\n+', text) if s.strip()]
+
+def cosine(a, b):
+    dot = sum(x * y for x, y in zip(a, b))
+    norm = math.sqrt(sum(x * x for x in a)) * math.sqrt(sum(y * y for y in b))
+    return dot / norm if norm else 0.0
+
+def add_snippets(embedder, query_embedding, results, top_n=2):
+    """Set each result's snippet to its sentences closest to the query.
+    
+    The top sentences are kept in their original order so the snippet reads
+    naturally. All sentences are embedded in one batch.
+    """
+    sentences = [split_sentences(r['text']) for r in results]
+    flat = [s for group in sentences for s in group]
+    if not flat:
+        return
+    vectors = embedder.encode([_passage_prefix + s for s in flat]).tolist()
+    offset = 0
+    for result, group in zip(results, sentences):
+        scores = [cosine(query_embedding, v) for v in vectors[offset:offset + len(group)]]
+        offset += len(group)
+        best = sorted(sorted(range(len(group)), key=lambda i: -scores[i])[:top_n])
+        result['snippet'] = ' ... '.join(group[i] for i in best)
+
+# With a recency boost or score weights, candidates beyond the limit can
+# overtake, so this many times the limit are fetched and re-ranked
+RECENCY_POOL = 4
+
+# Half-life in days for a recency weight sent without one
+DEFAULT_HALF_LIFE = 30
+
+def recency_decay(meta, half_life, now):
+    """The multiplier for a chunk's score under a recency boost: 1 when just
+    indexed, halving every half_life days. Chunks indexed before indexed_at
+    was recorded fall back to the file's mtime."""
+    stamp = meta.get('indexed_at') or meta.get('mtime')
+    if not stamp:
+        return 1.0
+    age_days = max(0.0, now - stamp) / 86400
+    return 0.5 ** (age_days / half_life)
+
+def check_score_weights(weights):
+    """Reject score weight keys weighted_score doesn't know."""
+    for key in weights:
+        if key not in ('vector', 'recency') and not key.startswith(('tag:', 'path:')):
+            raise ValueError(f"unknown score weight {key!r}: want vector, recency, tag:<name> or path:<dir>")
+
+def weighted_score(similarity, meta, weights, half_life, now):
+    """A chunk's score under score weights: vector times its similarity (a
+    vector weight of 1 if not given), plus recency times its recency decay,
+    plus each tag:<name> weight if it has that tag and each path:<dir>
+    weight if its file is under that directory."""
+    score = weights.get('vector', 1.0) * similarity
+    for key, weight in weights.items():
+        if key == 'recency':
+            score += weight * recency_decay(meta, half_life or DEFAULT_HALF_LIFE, now)
+        elif key.startswith('tag:') and meta.get(key):
+            score += weight
+        elif key.startswith('path:') and is_under(meta.get('path', ''), key[len('path:'):]):
+            score += weight
+    return score
+
+def search_vector(collection, query_embedding, limit=5, exclude_ids=(), half_life=None,
+                  with_text=True, score_weights=None):
+    """Nearest-neighbor search for a raw query vector; see search().
+    
+    With half_life (days), scores are decayed by age and the results
+    re-ranked, so newer chunks win over similar older ones. With
+    score_weights, scores are instead blended with metadata signals by
+    weighted_score, half_life setting the recency weight's decay. Without
+    with_text, Chroma isn't asked for the chunk texts and results have none.
+    """
+    if score_weights:
+        check_score_weights(score_weights)
+    rerank = bool(half_life or score_weights)
+    
+    # Trashed and excluded chunks are filtered out below. Counting the whole
+    # trash up front would cost a scan per query, so the query is widened
+    # instead, only while they leave it short
+    fetch = limit * RECENCY_POOL if rerank else limit
+    n_results = fetch + len(exclude_ids)
+    
+    query_ms = 0
+    while True:
+        start = time.perf_counter()
+        results = collection.query(
+            query_embeddings=[query_embedding],
+            n_results=n_results,
+            include=["documents", "metadatas", "distances"] if with_text else ["metadatas", "distances"]
+        )
+        query_ms += (time.perf_counter() - start) * 1000
+        ids = results['ids'][0] if results['ids'] else []
+        live = sum(1 for chunk_id, meta in zip(ids, results['metadatas'][0])
+                   if not is_trashed(meta) and chunk_id not in exclude_ids)
+        # Fewer than asked for means the collection has no more to give
+        if live >= fetch or len(ids) < n_results:
+            break
+        n_results *= 2
     
     # Format results
     formatted = []
+    now = time.time()
     if results['ids'] and results['ids'][0]:
         for i in range(len(results['ids'][0])):
-            formatted.append({
-                "id": results['ids'][0][i],
-                "score": 1 - results['distances'][0][i],  # Convert distance to similarity
-                "text": results['documents'][0][i],
-                "path": results['metadatas'][0][i]['path'],
-                "filename": results['metadatas'][0][i]['filename'],
-                "chunk_idx": results['metadatas'][0][i]['chunk_idx']
-            })
+            meta = results['metadatas'][0][i]
+            if is_trashed(meta) or results['ids'][0][i] in exclude_ids:
+                continue
+            score = 1 - results['distances'][0][i]  # Convert distance to similarity
+            if score_weights:
+                score = weighted_score(score, meta, score_weights, half_life, now)
+            elif half_life:
+                score *= recency_decay(meta, half_life, now)
+            text = results['documents'][0][i] if with_text else None
+            formatted.append(search_result(results['ids'][0][i], score, meta, text))
+            if len(formatted) == fetch:
+                break
+    if rerank:
+        formatted.sort(key=lambda r: r['score'], reverse=True)
+    
+    return formatted[:limit], query_ms, configured_ef_search(collection)
+
+def search_result(chunk_id, score, meta, text=None):
+    """A search result for a stored chunk; text is left out if None."""
+    result = {
+        "id": chunk_id,
+        "score": score,
+        "path": meta['path'],
+        "rel_path": meta.get('rel_path', ''),
+        "filename": meta['filename'],
+        "chunk_idx": meta['chunk_idx'],
+        "file_size": meta.get('file_size', 0),
+        "file_chunks": meta.get('file_chunks', 0),
+        "mtime": meta.get('mtime', 0),
+        "indexed_at": rfc3339(meta.get('indexed_at')),
+        "subject": meta.get('mail_subject', ''),
+        "sender": meta.get('mail_from', ''),
+        "tags": meta.get('tags', ''),
+        "title": meta.get('fm:title', ''),
+        "date": meta.get('fm:date', '')
+    }
+    if text is not None:
+        result['text'] = text
+    return result
+
+# How the keyword branch of hybrid search matches a query term against a
+# chunk's words: the whole word, its start, or anywhere in it
+KEYWORD_MODES = ('exact', 'prefix', 'substring')
+
+# Chunks containing a query term that the keyword branch reads and ranks
+KEYWORD_SCAN = 1000
+
+# Reciprocal rank fusion constant; larger values flatten the difference
+# between neighboring ranks
+RRF_K = 60
+
+def keyword_mode(mode):
+    if mode and mode not in KEYWORD_MODES:
+        raise ValueError(f"unknown keyword mode {mode!r} (want {', '.join(KEYWORD_MODES)})")
+    return mode or ''
+
+def keyword_pattern(term, mode):
+    """A case-insensitive regex for term matched the keyword_mode way."""
+    escaped = re.escape(term)
+    if mode == 'exact':
+        escaped = rf'\b{escaped}\b'
+    elif mode == 'prefix':
+        escaped = rf'\b{escaped}'
+    return re.compile(escaped, re.IGNORECASE)
+
+def keyword_search(collection, query, mode, limit):
+    """The keyword branch of hybrid search: IDs of chunks matching the
+    query's words under mode, those matching the most distinct words first,
+    then the most occurrences.
+    
+    Chroma finds the candidates by substring, which is case-sensitive, so
+    each word is looked for lowercase, capitalized and uppercase; the
+    patterns then apply the mode without regard to case.
+    """
+    terms = sorted(set(re.findall(r'\w+', query.lower())))
+    if not terms:
+        return []
+    clauses = [{"$contains": v} for t in terms for v in dict.fromkeys((t, t.capitalize(), t.upper()))]
+    found = collection.get(
+        where_document=clauses[0] if len(clauses) == 1 else {"$or": clauses},
+        limit=KEYWORD_SCAN, include=["documents", "metadatas"]
+    )
+    patterns = [keyword_pattern(t, mode) for t in terms]
+    ranked = []
+    for chunk_id, text, meta in zip(found['ids'], found['documents'], found['metadatas']):
+        if is_trashed(meta):
+            continue
+        hits = [len(p.findall(text)) for p in patterns]
+        matched = sum(1 for h in hits if h)
+        if matched:
+            ranked.append((-matched, -sum(hits), chunk_id))
+    ranked.sort()
+    return [chunk_id for _, _, chunk_id in ranked[:limit]]
+
+def hybrid_results(collection, query, mode, vector_results, limit, with_text=True):
+    """Fuse vector results with the keyword branch's by reciprocal rank.
+    
+    Each list adds 1 / (RRF_K + rank) to a chunk's score, so chunks ranked
+    well by both come first. Chunks only the keyword branch found are read
+    from the collection.
+    """
+    keyword_ids = keyword_search(collection, query, mode, limit * RECENCY_POOL)
+    fused = {}
+    for ranked in ([r['id'] for r in vector_results], keyword_ids):
+        for rank, chunk_id in enumerate(ranked, 1):
+            fused[chunk_id] = fused.get(chunk_id, 0) + 1 / (RRF_K + rank)
+    by_id = {r['id']: r for r in vector_results}
+    missing = [i for i in keyword_ids if i not in by_id]
+    if missing:
+        got = collection.get(ids=missing, include=["documents", "metadatas"])
+        for chunk_id, text, meta in zip(got['ids'], got['documents'], got['metadatas']):
+            by_id[chunk_id] = search_result(chunk_id, 0, meta, text if with_text else None)
+    best = sorted(fused, key=lambda i: fused[i], reverse=True)[:limit]
+    return [{**by_id[i], "score": fused[i]} for i in best]
+
+def matching_chunks(collection, tag=None, extensions=None, under=None, path=None):
+    """Find the chunks matching metadata filters, without embedding anything.
     
-    return formatted
+    Tags and exact file paths are matched by Chroma; extension and directory filters need suffix
+    and prefix matching it can't do, so they're applied to the metadata here.
+    Returns (path, chunk_idx, id) tuples ordered by path and position.
+    """
+    clauses = []
+    if tag:
+        clauses.append({f"tag:{tag}": True})
+    if path:
+        clauses.append({"path": path})
+    where = clauses[0] if len(clauses) == 1 else ({"$and": clauses} if clauses else None)
+    found = collection.get(where=where, include=["metadatas"])
+    exts = {e.lower().lstrip('.') for e in extensions or []}
+    matches = []
+    for chunk_id, meta in zip(found['ids'], found['metadatas']):
+        path = meta.get('path', '')
+        if is_trashed(meta):
+            continue
+        if exts and Path(path).suffix.lower().lstrip('.') not in exts:
+            continue
+        if under and not is_under(path, under):
+            continue
+        matches.append((path, meta.get('chunk_idx', 0), chunk_id))
+    matches.sort()
+    return matches
+
+
+def list_chunks(collection, tag=None, extensions=None, under=None, limit=50, offset=0, path=None):
+    """List chunks matching metadata filters, without embedding anything.
+    
+    Chunks are ordered by path and position so --offset pages are stable.
+    Returns one page of results and the total number of matches.
+    """
+    matches = matching_chunks(collection, tag, extensions, under, path)
+    page = matches[offset:offset + limit] if limit else matches[offset:]
+    if not page:
+        return [], len(matches)
+    
+    # Only fetch the text for the chunks being returned
+    got = collection.get(ids=[m[2] for m in page], include=["metadatas", "documents"])
+    by_id = dict(zip(got['ids'], zip(got['metadatas'], got['documents'])))
+    results = []
+    for _, _, chunk_id in page:
+        meta, text = by_id[chunk_id]
+        results.append({
+            "id": chunk_id,
+            "score": 0.0,
+            "text": text,
+            "path": meta['path'],
+            "rel_path": meta.get('rel_path', ''),
+            "filename": meta['filename'],
+            "chunk_idx": meta['chunk_idx'],
+            "file_size": meta.get('file_size', 0),
+            "file_chunks": meta.get('file_chunks', 0),
+            "mtime": meta.get('mtime', 0),
+            "indexed_at": rfc3339(meta.get('indexed_at')),
+            "subject": meta.get('mail_subject', ''),
+            "sender": meta.get('mail_from', ''),
+            "tags": meta.get('tags', ''),
+            "title": meta.get('fm:title', ''),
+            "date": meta.get('fm:date', '')
+        })
+    return results, len(matches)
+
+def search_by_id(collection, embedder, chunk_id, limit=5, snippets=False, half_life=None, score_weights=None):
+    """Find the nearest neighbors of a stored chunk, reusing its embedding.
+    
+    Ranking and snippets work as in search, with the chunk's embedding
+    standing in for the query's.
+    """
+    got = collection.get(ids=[chunk_id], include=["embeddings"])
+    if not got['ids']:
+        raise ValueError(f"no chunk with id {chunk_id}")
+    embedding = [float(x) for x in got['embeddings'][0]]
+    results, query_ms, ef_search = search_vector(
+        collection, embedding, limit, exclude_ids=(chunk_id,), half_life=half_life, score_weights=score_weights
+    )
+    if snippets:
+        add_snippets(embedder, embedding, results)
+    return results, query_ms, ef_search
+
+# Rocchio weights: keep the original query, pull toward liked chunks and
+# push (more gently) away from unliked ones
+ROCCHIO_ALPHA = 1.0
+ROCCHIO_BETA = 0.75
+ROCCHIO_GAMMA = 0.25
+
+def refine_vector(collection, query_embedding, like_ids=None, unlike_ids=None):
+    """Adjust a query vector with relevance feedback from stored chunks."""
+    refined = [ROCCHIO_ALPHA * float(x) for x in query_embedding]
+    for ids, weight in ((like_ids, ROCCHIO_BETA), (unlike_ids, -ROCCHIO_GAMMA)):
+        if not ids:
+            continue
+        embeddings = collection.get(ids=ids, include=["embeddings"])['embeddings']
+        if embeddings is None or len(embeddings) == 0:
+            continue
+        for embedding in embeddings:
+            for j, x in enumerate(embedding):
+                refined[j] += weight * float(x) / len(embeddings)
+    return refined
+
+BENCH_WORDS = (
+    "system index query vector memory file search chunk model embed note meeting plan "
+    "design review release deploy config server client cache database table schema "
+    "error retry timeout network request response token budget project team task"
+).split()
+
+def percentile(values, p):
+    """Nearest-rank percentile of a non-empty list."""
+    ordered = sorted(values)
+    return ordered[min(len(ordered) - 1, max(0, math.ceil(p / 100 * len(ordered)) - 1))]
+
+def bench(embedder, docs=200, queries=50, seed=42):
+    """Time indexing a synthetic corpus and searching it.
+    
+    Runs in a throwaway collection that's removed afterwards, so the user's
+    data is never touched. The corpus is seeded, so runs are comparable
+    across machines and models.
+    """
+    rng = random.Random(seed)
+    corpus = [
+        ' '.join(rng.choice(BENCH_WORDS) for _ in range(rng.randint(80, 400))) + '.'
+        for _ in range(docs)
+    ]
+    name = f"bench-{os.getpid()}-{int(time.time())}"
+    collection = _chroma_client.create_collection(name=name, metadata={"hnsw:space": "cosine"})
+    try:
+        chunks = 0
+        start = time.perf_counter()
+        for i, text in enumerate(corpus):
+            doc_chunks = chunk_text(text)
+            embeddings = embedder.encode([_passage_prefix + c for c in doc_chunks]).tolist()
+            retry_locked(collection.add,
+                ids=[f"bench{i}::{j}" for j in range(len(doc_chunks))],
+                embeddings=embeddings,
+                documents=doc_chunks
+            )
+            chunks += len(doc_chunks)
+        index_s = time.perf_counter() - start
+        
+        latencies = []
+        for _ in range(queries):
+            query = ' '.join(rng.choice(BENCH_WORDS) for _ in range(rng.randint(2, 6)))
+            start = time.perf_counter()
+            vector = embedder.encode([_query_prefix + query])[0].tolist()
+            collection.query(query_embeddings=[vector], n_results=5)
+            latencies.append((time.perf_counter() - start) * 1000)
+        search_s = sum(latencies) / 1000
+    finally:
+        _chroma_client.delete_collection(name)
+    
+    return {
+        "docs": docs,
+        "chunks": chunks,
+        "queries": queries,
+        "index_seconds": index_s,
+        "docs_per_sec": docs / index_s if index_s else 0,
+        "chunks_per_sec": chunks / index_s if index_s else 0,
+        "queries_per_sec": queries / search_s if search_s else 0,
+        "p50_ms": percentile(latencies, 50) if latencies else 0,
+        "p95_ms": percentile(latencies, 95) if latencies else 0,
+    }
+
+def embed_text(embedder, text, as_query=False):
+    """Encode text with the loaded model, without touching the collection.
+    as_query applies the query prefix, as search does."""
+    vector = embedder.encode([(_query_prefix if as_query else '') + text])[0].tolist()
+    return {"status": "ok", "embedding": vector, "model": MODEL_NAME, "dimension": len(vector)}
+
+# Commands that change the index, refused after an init with read_only
+WRITE_ACTIONS = {
+    'index_file', 'index_dir', 'index_chunks', 'reindex', 'clear', 'remove', 'restore', 'empty_trash', 'compact',
+    'copy_collection'
+}
+
+# Writes that apply --ef-search to the collection on the way
+INDEX_ACTIONS = {'index_file', 'index_dir', 'index_chunks', 'reindex'}
 
 def handle_command(cmd: dict) -> dict:
     """Handle incoming commands."""
-    global _collection, _embedder
+    global _collection, _embedder, _model_revision, _query_prefix, _passage_prefix, _read_only, _max_text_bytes, \
+        _ef_search
     
     action = cmd.get('cmd', '')
     
+    if _read_only and (action in WRITE_ACTIONS or (action == 'verify' and cmd.get('fix'))):
+        name = 'verify --fix' if action == 'verify' else action
+        return {"status": "error", "error": f"read-only mode: {name} is disabled"}
+    if action in INDEX_ACTIONS and _collection:
+        apply_ef_search(_collection, _ef_search)
+    
     if action == 'init':
         db_path = cmd.get('db_path', os.path.expanduser('~/.jb-recall/db'))
         os.makedirs(db_path, exist_ok=True)
-        _embedder = get_embedder()
-        _collection = get_collection(db_path)
+        hnsw = {}
+        if cmd.get('hnsw_ef_construction'):
+            hnsw["hnsw:construction_ef"] = cmd['hnsw_ef_construction']
+        if cmd.get('hnsw_m'):
+            hnsw["hnsw:M"] = cmd['hnsw_m']
+        _ef_search = cmd.get('ef_search') or 0
+        backend = cmd.get('backend') or DEFAULT_BACKEND
+        _embedder = get_embedder(backend)
+        _model_revision = model_revision(backend)
+        _query_prefix = cmd.get('query_prefix') or ''
+        _passage_prefix = cmd.get('passage_prefix') or ''
+        _read_only = cmd.get('read_only', False)
+        _max_text_bytes = cmd.get('max_text_bytes') or None
+        # A new collection starts with --ef-search; an existing one takes it
+        # at its next index run
+        creation = {**hnsw, "hnsw:search_ef": _ef_search} if _ef_search else hnsw
+        _collection = get_collection(
+            db_path, creation, backend, cmd.get('collection') or DEFAULT_COLLECTION,
+            {"query_prefix": _query_prefix, "passage_prefix": _passage_prefix}
+        )
         stats = _collection.count()
-        return {"status": "ok", "db_path": db_path, "count": stats}
+        warnings = hnsw_mismatches(_collection, hnsw, db_path) + backend_mismatch(_collection, backend)
+        return {
+            "status": "ok", "db_path": db_path, "count": stats,
+            "warnings": warnings + revision_mismatch(_collection, _model_revision)
+        }
+    
+    elif action == 'prefetch':
+        # Load the model and run it once so everything it downloads is
+        # cached, without opening the database
+        backend = cmd.get('backend') or DEFAULT_BACKEND
+        vector = get_embedder(backend).encode(['warmup'])[0]
+        return {"status": "ok", "model": MODEL_NAME, "backend": backend, "dimension": len(vector)}
+    
+    elif action == 'check':
+        missing = missing_modules(cmd.get('backend') or DEFAULT_BACKEND)
+        if missing:
+            return {"status": "error", "error": f"required packages not importable: {', '.join(missing)}"}
+        return {"status": "ok"}
     
     elif action == 'index_file':
         if not _collection:
             return {"status": "error", "error": "not initialized"}
-        return index_file(_collection, _embedder, cmd['path'], cmd.get('force', False))
+        return index_file(
+            _collection, _embedder, cmd['path'], cmd.get('force', False), cmd.get('chunk_strategy'),
+            cmd.get('tags'), compile_preprocessors(cmd.get('preprocess')), cmd.get('name'),
+            id_scheme=cmd.get('chunk_ids') or 'index', reuse=cmd.get('reuse_embeddings', False),
+            encoding=text_encoding(cmd.get('encoding')), frontmatter=frontmatter_mode(cmd.get('frontmatter'))
+        )
     
     elif action == 'index_dir':
         if not _collection:
             return {"status": "error", "error": "not initialized"}
-        return index_directory(
+        results = index_directory(
             _collection, _embedder, 
             cmd['path'], 
-            cmd.get('extensions'),
-            cmd.get('force', False)
+            index_extensions(cmd.get('extensions'), cmd.get('mail', False), cmd.get('archives', False)),
+            cmd.get('force', False),
+            cmd.get('follow_symlinks', False),
+            cmd.get('chunk_strategy'),
+            cmd.get('tags'),
+            compile_preprocessors(cmd.get('preprocess')),
+            cmd.get('chunk_ids') or 'index',
+            cmd.get('max_depth'),
+            cmd.get('only_new', False),
+            cmd.get('reuse_embeddings', False),
+            text_encoding(cmd.get('encoding')),
+            frontmatter_mode(cmd.get('frontmatter')),
+            cmd.get('archives', False),
+            cmd.get('max_concurrent_files') or 1
+        )
+        # The client skips replies without a status as stray output
+        return {"status": "ok", **results}
+    
+    elif action == 'index_chunks':
+        if not _collection:
+            return {"status": "error", "error": "not initialized"}
+        return index_chunks(
+            _collection, _embedder, cmd.get('path'), cmd.get('external_chunks') or [], cmd.get('force', False),
+            cmd.get('tags'), cmd.get('chunk_ids') or 'index'
+        )
+    
+    elif action == 'scan':
+        return scan_path(
+            cmd['path'], index_extensions(cmd.get('extensions'), cmd.get('mail', False), cmd.get('archives', False)),
+            cmd.get('follow_symlinks', False),
+            cmd.get('max_depth')
         )
     
     elif action == 'search':
         if not _collection:
             return {"status": "error", "error": "not initialized"}
-        results = search(_collection, _embedder, cmd['query'], cmd.get('limit', 5))
-        return {"status": "ok", "results": results}
+        args = (_collection, _embedder, cmd['query'], cmd.get('limit', 5), cmd.get('snippets', False),
+                cmd.get('half_life'))
+        mode = keyword_mode(cmd.get('keyword_mode'))
+        # A hybrid ranking needs both lists in full, so it isn't streamed
+        if cmd.get('stream') and not mode:
+            return stream_search(*args, cmd.get('fields'), score_weights=cmd.get('score_weights'))
+        results, query_ms, ef_search = search(
+            *args, with_text=not cmd.get('no_text'), score_weights=cmd.get('score_weights'), keyword_mode=mode
+        )
+        cap_text(results, _max_text_bytes)
+        return {
+            "status": "ok", "results": select_fields(results, cmd.get('fields')), "query_ms": query_ms, "ef_search": ef_search,
+            "warnings": prefix_mismatches(_collection),
+            "header": score_header(_collection, cmd.get('half_life'), cmd.get('score_weights'), mode)
+        }
+    
+    elif action == 'search_by_id':
+        if not _collection:
+            return {"status": "error", "error": "not initialized"}
+        results, query_ms, ef_search = search_by_id(
+            _collection, _embedder, cmd['chunk_id'], cmd.get('limit', 5), cmd.get('snippets', False),
+            cmd.get('half_life'), cmd.get('score_weights')
+        )
+        cap_text(results, _max_text_bytes)
+        return {
+            "status": "ok", "results": select_fields(results, cmd.get('fields')), "query_ms": query_ms,
+            "ef_search": ef_search, "header": score_header(_collection, cmd.get('half_life'), cmd.get('score_weights'))
+        }
+    
+    elif action == 'search_vector':
+        if not _collection:
+            return {"status": "error", "error": "not initialized"}
+        vector = refine_vector(
+            _collection, cmd['embedding'], cmd.get('like_ids'), cmd.get('unlike_ids')
+        )
+        results, query_ms, ef_search = search_vector(
+            _collection, vector, cmd.get('limit', 5)
+        )
+        cap_text(results, _max_text_bytes)
+        return {
+            "status": "ok", "results": results, "query_ms": query_ms, "ef_search": ef_search,
+            "warnings": prefix_mismatches(_collection), "header": score_header(_collection)
+        }
+    
+    elif action == 'embed':
+        return embed_text(_embedder or get_embedder(), cmd.get('text', ''), cmd.get('as_query', False))
     
     elif action == 'stats':
         if not _collection:
             return {"status": "error", "error": "not initialized"}
-        return {"status": "ok", "count": _collection.count()}
+        return {"status": "ok", "count": _collection.count(), "trashed": len(trashed_ids(_collection))}
+    
+    elif action == 'restore':
+        if not _collection:
+            return {"status": "error", "error": "not initialized"}
+        return {"status": "ok", "count": restore(_collection, cmd['path'])}
+    
+    elif action == 'empty_trash':
+        if not _collection:
+            return {"status": "error", "error": "not initialized"}
+        return {"status": "ok", "count": empty_trash(_collection)}
     
     elif action == 'clear':
         if _collection:
             all_ids = _collection.get()['ids']
             if all_ids:
-                _collection.delete(ids=all_ids)
+                retry_locked(_collection.delete, ids=all_ids)
         return {"status": "ok"}
     
+    elif action == 'list':
+        if not _collection:
+            return {"status": "error", "error": "not initialized"}
+        results, total = list_chunks(
+            _collection, cmd.get('tag'), cmd.get('extensions'), cmd.get('under'),
+            cmd.get('limit', 50), cmd.get('offset', 0), cmd.get('path')
+        )
+        return {"status": "ok", "results": results, "count": total}
+    
+    elif action == 'count':
+        if not _collection:
+            return {"status": "error", "error": "not initialized"}
+        matches = matching_chunks(
+            _collection, cmd.get('tag'), cmd.get('extensions'), cmd.get('under'), cmd.get('path')
+        )
+        return {"status": "ok", "count": len(matches)}
+    
+    elif action == 'bench':
+        if not _collection:
+            return {"status": "error", "error": "not initialized"}
+        return {"status": "ok", "bench": bench(_embedder, cmd.get('docs') or 200, cmd.get('queries') or 50)}
+    
+    elif action == 'remove':
+        if not _collection:
+            return {"status": "error", "error": "not initialized"}
+        return {"status": "ok", "count": remove_by_tag(_collection, cmd['tag'])}
+    
+    elif action == 'verify':
+        if not _collection:
+            return {"status": "error", "error": "not initialized"}
+        checked, anomalies, expected, total, removed = verify(_collection, _embedder, cmd.get('fix', False))
+        return {"status": "ok", "count": checked, "anomalies": anomalies, "expected": expected,
+                "chunks": total, "removed": removed}
+    
+    elif action == 'compact':
+        if not _collection:
+            return {"status": "error", "error": "not initialized"}
+        before, after = compact(cmd['db_path'])
+        return {"status": "ok", "size_before": before, "size_after": after, "count": _collection.count()}
+    
+    elif action == 'reindex':
+        if not _collection:
+            return {"status": "error", "error": "not initialized"}
+        result = reindex(
+            _collection, _embedder, cmd.get('resume', False), cmd.get('chunk_strategy'),
+            compile_preprocessors(cmd.get('preprocess')), cmd.get('chunk_ids') or 'index'
+        )
+        return {"status": "ok", **result}
+    
+    elif action == 'copy_collection':
+        if not _collection:
+            return {"status": "error", "error": "not initialized"}
+        count = copy_collection(cmd['source'], cmd['dest'], cmd.get('overwrite', False))
+        return {"status": "ok", "count": count}
+    
     elif action == 'quit':
         return {"status": "bye"}
     
     return {"status": "error", "error": f"unknown command: {action}"}
 
+class FramedQueue:
+    """JSONQueue's get/put over length-prefixed frames: a 4-byte big-endian
+    length, then that many bytes of JSON. Negotiated by the framing command."""
+    
+    def __init__(self, read_pipe, write_pipe):
+        self.read_pipe = read_pipe.buffer if hasattr(read_pipe, 'buffer') else read_pipe
+        self.write_pipe = write_pipe.buffer if hasattr(write_pipe, 'buffer') else write_pipe
+    
+    def put(self, obj, block=True, timeout=None):
+        data = json.dumps(obj).encode('utf-8')
+        self.write_pipe.write(struct.pack('>I', len(data)) + data)
+        self.write_pipe.flush()
+    
+    def get(self, block=True, timeout=None):
+        length, = struct.unpack('>I', self._read_exact(4))
+        return json.loads(self._read_exact(length).decode('utf-8'))
+    
+    def _read_exact(self, n):
+        data = b''
+        while len(data) < n:
+            chunk = self.read_pipe.read(n - len(data))
+            if not chunk:
+                raise EOFError("Pipe closed")
+            data += chunk
+        return data
+
+FRAMINGS = ['newline', 'length']
+
 def main():
     """Main loop using jumpboot's JSONQueue."""
     queue = jumpboot.JSONQueue(jumpboot.Pipe_in, jumpboot.Pipe_out)
     
+    signal.signal(signal.SIGINT, request_shutdown)
+    signal.signal(signal.SIGTERM, request_shutdown)
+    
     # Signal ready
-    queue.put({"status": "ready"})
+    queue.put({"status": "ready", "framings": FRAMINGS})
     
-    while True:
+    while not _shutdown_requested:
         try:
             cmd = queue.get(block=True, timeout=1)
         except TimeoutError:
@@ -227,13 +2277,34 @@ def main():
         if cmd is None:
             continue
         
+        # Switching framing is acknowledged in the old framing, then every
+        # later message uses the new one
+        if cmd.get('cmd') == 'framing':
+            if cmd.get('framing') not in FRAMINGS:
+                queue.put({"status": "error", "error": f"unknown framing: {cmd.get('framing')}"})
+                continue
+            queue.put({"status": "ok", "framing": cmd['framing']})
+            if cmd['framing'] == 'length':
+                queue = FramedQueue(jumpboot.Pipe_in, jumpboot.Pipe_out)
+            else:
+                queue = jumpboot.JSONQueue(jumpboot.Pipe_in, jumpboot.Pipe_out)
+            continue
+        
         try:
             result = handle_command(cmd)
-            queue.put(result)
-            if cmd.get('cmd') == 'quit':
+            # Streaming commands return a generator of messages ending with
+            # one whose status isn't "result"
+            if isinstance(result, types.GeneratorType):
+                for message in result:
+                    queue.put(message)
+            else:
+                queue.put(result)
+            if cmd.get('cmd') == 'quit' or _shutdown_requested:
                 break
         except Exception as e:
             queue.put({"status": "error", "error": str(e)})
+    
+    close_collection()
 
 if __name__ == "__main__":
     main()
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// jb-recall rpc speaks newline-delimited JSON-RPC 2.0 on stdin/stdout, so
+// editors and agents can drive it without parsing CLI output. Each method
+// is a thin wrapper over a Message command; requests are handled in order.
+// jb-recall mcp (mcp.go) runs its own methods over the same loop.
+
+// JSON-RPC error codes. rpcAppError covers failures reported by Python.
+const (
+	rpcParseError     = -32700
+	rpcInvalidRequest = -32600
+	rpcMethodNotFound = -32601
+	rpcInvalidParams  = -32602
+	rpcInternalError  = -32603
+	rpcAppError       = -32000
+)
+
+type rpcRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params"`
+}
+
+type rpcResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  any             `json:"result,omitempty"`
+	Error   *rpcError       `json:"error,omitempty"`
+}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *rpcError) Error() string { return e.Message }
+
+type rpcSearchParams struct {
+	Query    string   `json:"query"`
+	Limit    int      `json:"limit"`
+	MinScore float64  `json:"min_score"`
+	Fields   []string `json:"fields"`
+}
+
+type rpcIndexParams struct {
+	Path  string `json:"path"`
+	Force bool   `json:"force"`
+}
+
+// rpcHandler runs one method. Errors that aren't an *rpcError are reported
+// as internal errors.
+type rpcHandler func(method string, params json.RawMessage) (any, error)
+
+// runRPC answers requests from in until it is closed.
+func runRPC(in io.Reader, out io.Writer, handle rpcHandler) error {
+	r := bufio.NewReader(in)
+	enc := json.NewEncoder(out)
+	for {
+		line, err := r.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) > 0 {
+			if resp := handleRPC(line, handle); resp != nil {
+				if err := enc.Encode(resp); err != nil {
+					return err
+				}
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// handleRPC runs one request line. Notifications, which have no id, get
+// no response. Batches aren't supported; like any other JSON that isn't a
+// request object, they're an invalid request.
+func handleRPC(line []byte, handle rpcHandler) *rpcResponse {
+	if !json.Valid(line) {
+		return &rpcResponse{JSONRPC: "2.0", ID: json.RawMessage("null"), Error: &rpcError{rpcParseError, "parse error"}}
+	}
+	var req rpcRequest
+	if err := json.Unmarshal(line, &req); err != nil || req.JSONRPC != "2.0" || req.Method == "" {
+		id := req.ID
+		if id == nil {
+			id = json.RawMessage("null")
+		}
+		return &rpcResponse{JSONRPC: "2.0", ID: id, Error: &rpcError{rpcInvalidRequest, "invalid request"}}
+	}
+
+	result, err := handle(req.Method, req.Params)
+	if req.ID == nil {
+		return nil
+	}
+	resp := &rpcResponse{JSONRPC: "2.0", ID: req.ID, Result: result}
+	if err != nil {
+		var rerr *rpcError
+		if !errors.As(err, &rerr) {
+			rerr = &rpcError{rpcInternalError, err.Error()}
+		}
+		resp.Result, resp.Error = nil, rerr
+	}
+	return resp
+}
+
+// recallMethods maps the rpc methods onto the matching commands.
+func recallMethods(client *RecallClient, maxLimit int) rpcHandler {
+	return func(method string, params json.RawMessage) (any, error) {
+		switch method {
+		case "recall.search":
+			var p rpcSearchParams
+			if err := decodeParams(params, &p); err != nil {
+				return nil, err
+			}
+			resp, err := rpcSearch(client, p, maxLimit)
+			if err != nil {
+				return nil, err
+			}
+			return withFields(resp, p.Fields), nil
+
+		case "recall.index":
+			var p rpcIndexParams
+			if err := decodeParams(params, &p); err != nil {
+				return nil, err
+			}
+			return rpcIndex(client, p)
+
+		case "recall.stats":
+			return rpcCall(client, Message{Cmd: "stats"})
+		}
+		return nil, &rpcError{rpcMethodNotFound, fmt.Sprintf("method not found: %s", method)}
+	}
+}
+
+func rpcSearch(client *RecallClient, p rpcSearchParams, maxLimit int) (*Message, error) {
+	if p.Query == "" {
+		return nil, &rpcError{rpcInvalidParams, "query is required"}
+	}
+	if p.Limit < 0 {
+		return nil, &rpcError{rpcInvalidParams, "limit must be a positive number"}
+	}
+	if err := checkFields(p.Fields); err != nil {
+		return nil, &rpcError{rpcInvalidParams, err.Error()}
+	}
+	limit := 5
+	if p.Limit > 0 {
+		limit = min(p.Limit, maxLimit)
+	}
+	resp, err := rpcCall(client, Message{Cmd: "search", Query: p.Query, Limit: limit})
+	if err != nil {
+		return nil, err
+	}
+	resp.Results = aboveScore(resp.Results, p.MinScore)
+	return resp, nil
+}
+
+// rpcIndex indexes a file or, recursively, a directory.
+func rpcIndex(client *RecallClient, p rpcIndexParams) (*Message, error) {
+	if p.Path == "" {
+		return nil, &rpcError{rpcInvalidParams, "path is required"}
+	}
+	path, _ := filepath.Abs(p.Path)
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, &rpcError{rpcInvalidParams, err.Error()}
+	}
+	msg := Message{Cmd: "index_file", Path: path, Force: p.Force}
+	if info.IsDir() {
+		msg.Cmd = "index_dir"
+	}
+	return rpcCall(client, msg)
+}
+
+// decodeParams reads named params into v. Absent params leave v zero.
+func decodeParams(params json.RawMessage, v any) error {
+	if len(params) == 0 || string(params) == "null" {
+		return nil
+	}
+	if err := json.Unmarshal(params, v); err != nil {
+		return &rpcError{rpcInvalidParams, "invalid params: " + err.Error()}
+	}
+	return nil
+}
+
+func rpcCall(client *RecallClient, msg Message) (*Message, error) {
+	resp, err := client.call(msg)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Status == "error" {
+		return nil, &rpcError{rpcAppError, resp.Error}
+	}
+	return resp, nil
+}
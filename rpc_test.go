@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// echoMethods answers "echo" with its params, "fail" with a plain error
+// and "app" with a Python-side error; anything else is not found, as in
+// recallMethods.
+func echoMethods(called *[]string) rpcHandler {
+	return func(method string, params json.RawMessage) (any, error) {
+		*called = append(*called, method)
+		switch method {
+		case "echo":
+			return params, nil
+		case "fail":
+			return nil, errors.New("boom")
+		case "app":
+			return nil, &rpcError{rpcAppError, "not initialized"}
+		}
+		return nil, &rpcError{rpcMethodNotFound, "method not found: " + method}
+	}
+}
+
+func TestHandleRPC(t *testing.T) {
+	tests := []struct {
+		name     string
+		line     string
+		wantResp bool   // false for notifications
+		wantID   string // the response id as JSON
+		wantCode int    // 0 for success
+		wantCall string // the method the handler should see, if any
+	}{
+		{"call", `{"jsonrpc":"2.0","id":1,"method":"echo","params":{"q":"x"}}`, true, `1`, 0, "echo"},
+		{"string id", `{"jsonrpc":"2.0","id":"abc","method":"echo"}`, true, `"abc"`, 0, "echo"},
+		{"null id", `{"jsonrpc":"2.0","id":null,"method":"echo"}`, true, `null`, 0, "echo"},
+		{"notification", `{"jsonrpc":"2.0","method":"echo"}`, false, ``, 0, "echo"},
+		{"failed notification", `{"jsonrpc":"2.0","method":"fail"}`, false, ``, 0, "fail"},
+		{"unknown method", `{"jsonrpc":"2.0","id":2,"method":"recall.nope"}`, true, `2`, rpcMethodNotFound, "recall.nope"},
+		{"handler error", `{"jsonrpc":"2.0","id":3,"method":"fail"}`, true, `3`, rpcInternalError, "fail"},
+		{"app error", `{"jsonrpc":"2.0","id":4,"method":"app"}`, true, `4`, rpcAppError, "app"},
+
+		{"parse error", `{"jsonrpc":"2.0","id":5,"method":`, true, `null`, rpcParseError, ""},
+		{"not json", `hello`, true, `null`, rpcParseError, ""},
+
+		{"missing version", `{"id":6,"method":"echo"}`, true, `6`, rpcInvalidRequest, ""},
+		{"wrong version", `{"jsonrpc":"1.0","id":7,"method":"echo"}`, true, `7`, rpcInvalidRequest, ""},
+		{"missing method", `{"jsonrpc":"2.0","id":8}`, true, `8`, rpcInvalidRequest, ""},
+		{"method not a string", `{"jsonrpc":"2.0","id":9,"method":1}`, true, `9`, rpcInvalidRequest, ""},
+		{"invalid notification", `{"jsonrpc":"2.0"}`, true, `null`, rpcInvalidRequest, ""},
+		{"batch", `[{"jsonrpc":"2.0","id":10,"method":"echo"}]`, true, `null`, rpcInvalidRequest, ""},
+		{"empty batch", `[]`, true, `null`, rpcInvalidRequest, ""},
+		{"scalar", `42`, true, `null`, rpcInvalidRequest, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var called []string
+			resp := handleRPC([]byte(tt.line), echoMethods(&called))
+
+			wantCalls := 0
+			if tt.wantCall != "" {
+				wantCalls = 1
+			}
+			if len(called) != wantCalls || (wantCalls == 1 && called[0] != tt.wantCall) {
+				t.Errorf("handler saw %v, want %q", called, tt.wantCall)
+			}
+			if !tt.wantResp {
+				if resp != nil {
+					t.Fatalf("got a response to a notification: %+v", resp)
+				}
+				return
+			}
+			if resp == nil {
+				t.Fatal("got no response")
+			}
+			if resp.JSONRPC != "2.0" {
+				t.Errorf("jsonrpc = %q, want 2.0", resp.JSONRPC)
+			}
+			if string(resp.ID) != tt.wantID {
+				t.Errorf("id = %s, want %s", resp.ID, tt.wantID)
+			}
+			switch {
+			case tt.wantCode == 0 && resp.Error != nil:
+				t.Errorf("got error %d %q, want a result", resp.Error.Code, resp.Error.Message)
+			case tt.wantCode != 0 && resp.Error == nil:
+				t.Errorf("got result %v, want error %d", resp.Result, tt.wantCode)
+			case tt.wantCode != 0 && resp.Error.Code != tt.wantCode:
+				t.Errorf("error code = %d, want %d", resp.Error.Code, tt.wantCode)
+			case tt.wantCode != 0 && resp.Result != nil:
+				t.Errorf("error response also carries result %v", resp.Result)
+			}
+		})
+	}
+}
+
+func TestHandleRPCWire(t *testing.T) {
+	// A response must carry exactly one of result and error
+	var called []string
+	tests := []struct {
+		line string
+		want string
+	}{
+		{`{"jsonrpc":"2.0","id":1,"method":"echo","params":[1]}`, `{"jsonrpc":"2.0","id":1,"result":[1]}`},
+		{`{"jsonrpc":"2.0","id":2,"method":"app"}`, `{"jsonrpc":"2.0","id":2,"error":{"code":-32000,"message":"not initialized"}}`},
+		{`{`, `{"jsonrpc":"2.0","id":null,"error":{"code":-32700,"message":"parse error"}}`},
+	}
+	for _, tt := range tests {
+		data, err := json.Marshal(handleRPC([]byte(tt.line), echoMethods(&called)))
+		if err != nil {
+			t.Fatalf("%s: %v", tt.line, err)
+		}
+		if string(data) != tt.want {
+			t.Errorf("%s:\n got %s\nwant %s", tt.line, data, tt.want)
+		}
+	}
+}
+
+func TestRecallMethodsUnknown(t *testing.T) {
+	// Unknown methods are refused before the client is touched
+	resp := handleRPC([]byte(`{"jsonrpc":"2.0","id":1,"method":"recall.nope"}`), recallMethods(nil, 10))
+	if resp == nil || resp.Error == nil || resp.Error.Code != rpcMethodNotFound {
+		t.Fatalf("got %+v, want a method not found error", resp)
+	}
+	if !strings.Contains(resp.Error.Message, "recall.nope") {
+		t.Errorf("message %q doesn't name the method", resp.Error.Message)
+	}
+}
+
+func TestRunRPC(t *testing.T) {
+	in := strings.NewReader(`{"jsonrpc":"2.0","id":1,"method":"echo"}` + "\n" +
+		"\n" +
+		`{"jsonrpc":"2.0","method":"echo"}` + "\n" +
+		`{"jsonrpc":"2.0","id":2,"method":"missing"}`) // no trailing newline
+	var out strings.Builder
+	var called []string
+	if err := runRPC(in, &out, echoMethods(&called)); err != nil {
+		t.Fatalf("runRPC: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("got %d responses, want 2 (blank lines and notifications get none):\n%s", len(lines), out.String())
+	}
+	if len(called) != 3 {
+		t.Errorf("handler ran %d times, want 3", len(called))
+	}
+	var last rpcResponse
+	if err := json.Unmarshal([]byte(lines[1]), &last); err != nil {
+		t.Fatal(err)
+	}
+	if string(last.ID) != "2" || last.Error == nil || last.Error.Code != rpcMethodNotFound {
+		t.Errorf("last response = %s, want method not found for id 2", lines[1])
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// SavedQuery is a search stored by --save-query. Args is the search's full
+// argument list, so the query text, --limit, --min-score and any filters
+// are all replayed exactly.
+type SavedQuery struct {
+	Args  []string  `json:"args"`
+	Saved time.Time `json:"saved"`
+}
+
+func savedQueriesPath(rootDir string) string {
+	return filepath.Join(rootDir, "saved_queries.json")
+}
+
+func loadSavedQueries(rootDir string) (map[string]SavedQuery, error) {
+	saved := make(map[string]SavedQuery)
+	data, err := os.ReadFile(savedQueriesPath(rootDir))
+	if os.IsNotExist(err) {
+		return saved, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", savedQueriesPath(rootDir), err)
+	}
+	return saved, nil
+}
+
+// saveQuery stores args under name, dropping the --save-query flag itself.
+func saveQuery(rootDir, name string, args []string) error {
+	saved, err := loadSavedQueries(rootDir)
+	if err != nil {
+		return err
+	}
+	var kept []string
+	for i := 0; i < len(args); i++ {
+		if args[i] == "--save-query" {
+			i++
+			continue
+		}
+		kept = append(kept, args[i])
+	}
+	saved[name] = SavedQuery{Args: kept, Saved: time.Now()}
+	data, err := json.MarshalIndent(saved, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(savedQueriesPath(rootDir), data, 0644)
+}
+
+// savedSearchArgs turns "jb-recall saved <name> [extra flags]" into the
+// equivalent os.Args for the stored search. With no name it lists the
+// saved queries and exits.
+func savedSearchArgs(rootDir string, args []string) []string {
+	saved, err := loadSavedQueries(rootDir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	names := positional(args[2:])
+	if len(names) == 0 {
+		if len(saved) == 0 {
+			fmt.Println("No saved queries (save one with jb-recall search <query> --save-query <name>).")
+		}
+		var sorted []string
+		for name := range saved {
+			sorted = append(sorted, name)
+		}
+		sort.Strings(sorted)
+		for _, name := range sorted {
+			fmt.Printf("%-20s %q\n", name, positional(saved[name].Args))
+		}
+		os.Exit(0)
+	}
+
+	query, ok := saved[names[0]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Error: no saved query named %q\n", names[0])
+		os.Exit(1)
+	}
+	// Flags given to saved (e.g. --verbose) are added to the stored ones
+	var extra []string
+	dropped := false
+	for _, a := range args[2:] {
+		if a == names[0] && !dropped {
+			dropped = true
+			continue
+		}
+		extra = append(extra, a)
+	}
+	out := append([]string{args[0], "search"}, query.Args...)
+	return append(out, extra...)
+}
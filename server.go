@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const defaultServeAddr = "127.0.0.1:7700"
+
+// shutdownTimeout bounds how long in-flight requests may run after SIGTERM.
+const shutdownTimeout = 30 * time.Second
+
+// recallServer exposes a RecallClient over HTTP. The client is started in
+// the background so probes can answer while first-run setup is in progress.
+type recallServer struct {
+	mu       sync.RWMutex
+	client   *RecallClient
+	startErr error
+	closed   bool
+	maxLimit int // changes on SIGHUP
+}
+
+// serve runs the HTTP server until it is signalled or, with a non-zero
+// idle, until no request has arrived for that long.
+func serve(rootDir, addr string, opts ClientOptions, maxLimit int, reloader *configReloader, idle time.Duration) error {
+	s := &recallServer{maxLimit: maxLimit}
+	go s.start(rootDir, opts)
+	defer s.close()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /healthz", s.handleHealth)
+	mux.HandleFunc("GET /readyz", s.handleReady)
+	mux.HandleFunc("GET /search", s.handleSearch)
+	mux.HandleFunc("GET /stats", s.handleStats)
+
+	srv := &http.Server{Addr: addr, Handler: mux}
+	var idleC <-chan time.Time
+	if idle > 0 {
+		t := &idleTimer{idle: idle, timer: time.NewTimer(idle)}
+		idleC = t.timer.C
+		srv.Handler = t.track(mux)
+	}
+
+	// On SIGINT/SIGTERM stop accepting connections and let in-flight requests
+	// finish; the deferred close then stops the Python process. SIGHUP
+	// rereads the config.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	errc := make(chan error, 1)
+	go func() {
+		logger.Info("Listening on "+addr, "addr", addr)
+		errc <- srv.ListenAndServe()
+	}()
+
+	for ctx.Err() == nil {
+		select {
+		case err := <-errc:
+			return err
+		case <-hup:
+			s.reload(reloader)
+		case <-idleC:
+			logger.Info(fmt.Sprintf("%s idle for %s, exiting", time.Now().Format(time.RFC3339), idle), "idle_timeout", idle.String())
+			stop()
+		case <-ctx.Done():
+		}
+	}
+
+	logger.Info("Shutting down...")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	return srv.Shutdown(shutdownCtx)
+}
+
+// probeRoutes answer health checks, which arrive on a schedule whether or
+// not anyone is using the server, so they don't count as activity.
+var probeRoutes = map[string]bool{"/healthz": true, "/readyz": true}
+
+// idleTimer runs only while no request is in progress, so it fires once
+// the server has had none, probes aside, for idle.
+type idleTimer struct {
+	mu     sync.Mutex
+	active int
+	idle   time.Duration
+	timer  *time.Timer
+}
+
+func (t *idleTimer) track(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if probeRoutes[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		t.mu.Lock()
+		t.active++
+		t.timer.Stop()
+		t.mu.Unlock()
+		defer func() {
+			t.mu.Lock()
+			if t.active--; t.active == 0 {
+				t.timer.Reset(t.idle)
+			}
+			t.mu.Unlock()
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// start creates the Python process and opens the database. Until it
+// finishes, every endpoint answers 503.
+func (s *recallServer) start(rootDir string, opts ClientOptions) {
+	client, err := NewRecallClient(rootDir, opts)
+	if err == nil {
+		var resp *Message
+		resp, err = client.initDatabase(rootDir)
+		if err != nil {
+			client.Close()
+		} else {
+			printWarnings(resp)
+			logger.Info(fmt.Sprintf("Database ready (%d chunks indexed)", resp.Count), "chunks", resp.Count)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil {
+		logger.Error(fmt.Sprintf("Startup error: %v", err), "error", err.Error())
+		s.startErr = err
+		return
+	}
+	// The server may have shut down while we were still starting
+	if s.closed {
+		client.Close()
+		return
+	}
+	s.client = client
+}
+
+// reload applies a changed config file; of its settings only max_limit
+// can change while serving.
+func (s *recallServer) reload(reloader *configReloader) {
+	cfg, err := reloader.load()
+	if err != nil {
+		logger.Warn(fmt.Sprintf("Reload failed, keeping the current config: %v", err), "error", err.Error())
+		return
+	}
+	s.mu.Lock()
+	s.maxLimit = cfg.maxLimit()
+	s.mu.Unlock()
+	logger.Info(fmt.Sprintf("Reloaded %s (max_limit %d)", reloader.path, cfg.maxLimit()), "path", reloader.path, "max_limit", cfg.maxLimit())
+}
+
+func (s *recallServer) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	if s.client != nil {
+		s.client.Close()
+	}
+}
+
+// readyClient returns the client once startup has finished and the Python
+// process is alive; otherwise it writes a 503 and returns nil.
+func (s *recallServer) readyClient(w http.ResponseWriter) *RecallClient {
+	s.mu.RLock()
+	client, err := s.client, s.startErr
+	s.mu.RUnlock()
+
+	switch {
+	case err != nil:
+		writeJSON(w, http.StatusServiceUnavailable, Message{Status: "error", Error: err.Error()})
+	case client == nil:
+		writeJSON(w, http.StatusServiceUnavailable, Message{Status: "starting"})
+	case !client.Alive():
+		writeJSON(w, http.StatusServiceUnavailable, Message{Status: "error", Error: "python process exited"})
+	default:
+		return client
+	}
+	return nil
+}
+
+// handleHealth is the liveness probe: the process is up and the model loaded.
+func (s *recallServer) handleHealth(w http.ResponseWriter, r *http.Request) {
+	if s.readyClient(w) == nil {
+		return
+	}
+	writeJSON(w, http.StatusOK, Message{Status: "ok"})
+}
+
+// handleReady is the readiness probe: additionally checks the db answers.
+func (s *recallServer) handleReady(w http.ResponseWriter, r *http.Request) {
+	client := s.readyClient(w)
+	if client == nil {
+		return
+	}
+	resp, err := client.call(Message{Cmd: "stats"})
+	if err == nil && resp.Status == "error" {
+		err = errors.New(resp.Error)
+	}
+	if err != nil {
+		writeJSON(w, http.StatusServiceUnavailable, Message{Status: "error", Error: err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, Message{Status: "ok", Count: resp.Count})
+}
+
+func (s *recallServer) handleSearch(w http.ResponseWriter, r *http.Request) {
+	client := s.readyClient(w)
+	if client == nil {
+		return
+	}
+	query := r.URL.Query().Get("q")
+	if query == "" {
+		writeJSON(w, http.StatusBadRequest, Message{Status: "error", Error: "missing q parameter"})
+		return
+	}
+	limit := 5
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			writeJSON(w, http.StatusBadRequest, Message{Status: "error", Error: "limit must be a positive number"})
+			return
+		}
+		s.mu.RLock()
+		limit = min(n, s.maxLimit)
+		s.mu.RUnlock()
+	}
+	var fields []string
+	if v := r.URL.Query().Get("fields"); v != "" {
+		fields = strings.Split(v, ",")
+		if err := checkFields(fields); err != nil {
+			writeJSON(w, http.StatusBadRequest, Message{Status: "error", Error: err.Error()})
+			return
+		}
+	}
+	s.forward(w, client, Message{Cmd: "search", Query: query, Limit: limit, Fields: fields})
+}
+
+func (s *recallServer) handleStats(w http.ResponseWriter, r *http.Request) {
+	client := s.readyClient(w)
+	if client == nil {
+		return
+	}
+	s.forward(w, client, Message{Cmd: "stats"})
+}
+
+// forward relays msg to Python and writes its response, with results cut
+// down to msg.Fields if any are given.
+func (s *recallServer) forward(w http.ResponseWriter, client *RecallClient, msg Message) {
+	resp, err := client.call(msg)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, Message{Status: "error", Error: err.Error()})
+		return
+	}
+	if resp.Status == "error" {
+		writeJSON(w, http.StatusInternalServerError, resp)
+		return
+	}
+	writeJSON(w, http.StatusOK, withFields(resp, msg.Fields))
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,48 @@
+"""Tests for recall.py helpers that need no model or database.
+
+Run with: python3 -m unittest test_recall
+"""
+import ntpath
+import posixpath
+import sys
+import types
+import unittest
+from unittest import mock
+
+# recall.py runs inside jumpboot's environment; its helpers don't need it
+try:
+    import jumpboot  # noqa: F401
+except ImportError:
+    sys.modules['jumpboot'] = types.ModuleType('jumpboot')
+
+import recall
+
+
+def with_paths(flavor, sep):
+    """Run is_under as it would on a platform with the given os.path and separator."""
+    return mock.patch.object(recall, 'os', types.SimpleNamespace(path=flavor, sep=sep))
+
+
+class IsUnderTest(unittest.TestCase):
+    def test_windows_separators_and_case(self):
+        with with_paths(ntpath, '\\'):
+            self.assertTrue(recall.is_under('C:\\Notes\\a.md', 'C:\\Notes'))
+            self.assertTrue(recall.is_under('C:/Notes/sub/a.md', 'c:\\notes'))
+            self.assertTrue(recall.is_under('c:\\notes\\a.md', 'C:/Notes/'))
+            self.assertTrue(recall.is_under('C:\\Notes', 'c:/notes'))
+            self.assertTrue(recall.is_under('C:\\Notes\\.\\x\\..\\a.md', 'C:\\Notes'))
+            self.assertFalse(recall.is_under('C:\\Notesbook\\a.md', 'C:\\Notes'))
+            self.assertFalse(recall.is_under('D:\\Notes\\a.md', 'C:\\Notes'))
+            self.assertTrue(recall.is_under('C:\\a.md', 'C:\\'))
+
+    def test_posix_keeps_case(self):
+        with with_paths(posixpath, '/'):
+            self.assertTrue(recall.is_under('/home/u/notes/a.md', '/home/u/notes/'))
+            self.assertTrue(recall.is_under('/home/u//notes/./a.md', '/home/u/notes'))
+            self.assertFalse(recall.is_under('/home/u/Notes/a.md', '/home/u/notes'))
+            self.assertFalse(recall.is_under('/home/u/notesbook/a.md', '/home/u/notes'))
+            self.assertTrue(recall.is_under('/a.md', '/'))
+
+
+if __name__ == '__main__':
+    unittest.main()
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"time"
+)
+
+// With daemon --watch, the helper keeps the directories listed under
+// "watch" in config.json indexed. Each is polled: a cheap fingerprint of
+// its tree is compared with the last pass, and only a directory that
+// changed gets an index run, which itself skips unchanged files and trashes
+// deleted ones. The first pass indexes everything.
+
+// defaultWatchInterval is how often watched directories are checked.
+const defaultWatchInterval = 30 * time.Second
+
+type watchOptions struct {
+	dirs     []string
+	interval time.Duration
+	// index is the index_dir request to send, minus the path, carrying the
+	// config's chunk strategies, preprocessors, chunk ID scheme and
+	// frontmatter mode
+	index Message
+}
+
+// newWatchOptions reads the watch settings from cfg, with args overriding
+// how files are chunked as they do for index.
+func newWatchOptions(cfg *Config, args []string, opts ClientOptions) (*watchOptions, error) {
+	w := &watchOptions{interval: defaultWatchInterval}
+	if cfg.WatchInterval > 0 {
+		w.interval = time.Duration(cfg.WatchInterval) * time.Second
+	}
+	var err error
+	if w.dirs, err = cfg.watchDirs(); err != nil {
+		return nil, err
+	}
+	if w.index.ChunkStrategy, err = chunkStrategies(cfg, args); err != nil {
+		return nil, err
+	}
+	if w.index.ChunkIDs, err = chunkIDsFlag(cfg, args); err != nil {
+		return nil, err
+	}
+	if w.index.Frontmatter, err = frontmatterFlag(cfg, args); err != nil {
+		return nil, err
+	}
+	w.index.Preprocess = preprocessors(cfg, args)
+	switch {
+	case len(w.dirs) == 0:
+		return nil, errors.New("--watch needs directories under \"watch\" in config.json")
+	case opts.ReadOnly:
+		return nil, errors.New("--watch can't index in read-only mode")
+	}
+	return w, nil
+}
+
+// treeFingerprint summarizes dir's tree by entry count, total file size and
+// newest modification time. Directories count too, since creating, deleting
+// or renaming a file updates its parent's mtime. skip, the root directory,
+// is left out so watching a parent of it (such as ~) doesn't see every
+// index run as a change.
+func treeFingerprint(dir, skip string) (string, error) {
+	var entries, size int64
+	var newest time.Time
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// A file removed mid-walk will show up in the next pass
+			if errors.Is(err, fs.ErrNotExist) && path != dir {
+				return nil
+			}
+			return err
+		}
+		if path == skip {
+			return filepath.SkipDir
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		entries++
+		if !d.IsDir() {
+			size += info.Size()
+		}
+		if info.ModTime().After(newest) {
+			newest = info.ModTime()
+		}
+		return nil
+	})
+	return fmt.Sprintf("%d/%d/%d", entries, size, newest.UnixNano()), err
+}
+
+// watchDirs indexes the watched directories whenever they change, until
+// ctx is done. Options sent on updates replace w from the next pass, which
+// starts at once; directories newly added are indexed in it.
+func watchDirs(ctx context.Context, client *RecallClient, rootDir string, w *watchOptions, updates <-chan *watchOptions) {
+	last := make(map[string]string)
+	for {
+		for _, dir := range w.dirs {
+			fp, err := treeFingerprint(dir, rootDir)
+			if err != nil {
+				logger.Warn(fmt.Sprintf("watch %s: %v", dir, err), "dir", dir, "error", err.Error())
+				continue
+			}
+			if fp == last[dir] {
+				continue
+			}
+			if err := indexWatched(client, rootDir, w.index, dir); err != nil {
+				logger.Warn(fmt.Sprintf("watch %s: %v", dir, err), "dir", dir, "error", err.Error())
+				continue
+			}
+			last[dir] = fp
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case w = <-updates:
+		case <-time.After(w.interval):
+		}
+	}
+}
+
+// indexWatched runs an incremental index of dir. The helper's Python
+// process is shared, and each CLI client points it at its own database and
+// collection, so init and index go together under the client lock.
+func indexWatched(client *RecallClient, rootDir string, index Message, dir string) error {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+
+	index.Cmd, index.Path = "index_dir", dir
+	for _, msg := range []Message{client.initMessage(rootDir), index} {
+		if err := client.send(msg); err != nil {
+			return err
+		}
+		resp, err := client.recv()
+		if err != nil {
+			return err
+		}
+		if resp.Status == "error" {
+			return errors.New(resp.Error)
+		}
+		if msg.Cmd == "index_dir" && (resp.Indexed > 0 || resp.Trashed > 0) {
+			logger.Info(fmt.Sprintf("%s watch %s: indexed %d files (%d chunks), trashed %d", time.Now().Format(time.RFC3339), dir, resp.Indexed, resp.Chunks, resp.Trashed),
+				"dir", dir, "indexed", resp.Indexed, "chunks", resp.Chunks, "trashed", resp.Trashed)
+		}
+	}
+	return nil
+}